@@ -0,0 +1,515 @@
+package jpeg
+
+/*
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include "jpeglib.h"
+#include "jpeg.h"
+
+static int read_coefficients(j_decompress_ptr dinfo, jvirt_barray_ptr **arrays) {
+	// handle error
+	struct my_error_mgr *err = (struct my_error_mgr *)dinfo->err;
+	if (setjmp(err->jmpbuf) != 0) {
+		return err->pub.msg_code;
+	}
+
+	*arrays = jpeg_read_coefficients(dinfo);
+	return 0;
+}
+
+// copy_blocks copies rows of width blocks between a virtual block array and
+// the contiguous buffer blocks.
+static int copy_blocks(j_common_ptr cinfo, jvirt_barray_ptr array, JCOEF *blocks, JDIMENSION width, JDIMENSION rows, boolean writable) {
+	// handle error
+	struct my_error_mgr *err = (struct my_error_mgr *)cinfo->err;
+	if (setjmp(err->jmpbuf) != 0) {
+		return err->pub.msg_code;
+	}
+
+	JDIMENSION row;
+	for (row = 0; row < rows; row++) {
+		JBLOCKARRAY buffer = (*cinfo->mem->access_virt_barray)(cinfo, array, row, 1, writable);
+		JCOEF *p = blocks + (size_t)row * width * DCTSIZE2;
+		if (writable) {
+			memcpy(buffer[0], p, width * sizeof(JBLOCK));
+		} else {
+			memcpy(p, buffer[0], width * sizeof(JBLOCK));
+		}
+	}
+	return 0;
+}
+
+static void save_markers(j_decompress_ptr dinfo, boolean comments, boolean app) {
+	jpeg_save_markers(dinfo, JPEG_COM, comments ? 0xFFFF : 0);
+	int m;
+	for (m = 0; m < 16; m++) {
+		jpeg_save_markers(dinfo, JPEG_APP0 + m, app ? 0xFFFF : 0);
+	}
+}
+
+static int setup_coefficients(j_compress_ptr cinfo, J_COLOR_SPACE color_space, int num_components) {
+	// handle error
+	struct my_error_mgr *err = (struct my_error_mgr *)cinfo->err;
+	if (setjmp(err->jmpbuf) != 0) {
+		return err->pub.msg_code;
+	}
+
+	cinfo->in_color_space = color_space;
+	cinfo->input_components = num_components;
+	jpeg_set_defaults(cinfo);
+	jpeg_set_colorspace(cinfo, color_space);
+	return 0;
+}
+
+static int set_quant_table(j_compress_ptr cinfo, int n, UINT16 *values) {
+	// handle error
+	struct my_error_mgr *err = (struct my_error_mgr *)cinfo->err;
+	if (setjmp(err->jmpbuf) != 0) {
+		return err->pub.msg_code;
+	}
+
+	if (cinfo->quant_tbl_ptrs[n] == NULL) {
+		cinfo->quant_tbl_ptrs[n] = jpeg_alloc_quant_table((j_common_ptr)cinfo);
+	}
+	memcpy(cinfo->quant_tbl_ptrs[n]->quantval, values, sizeof(cinfo->quant_tbl_ptrs[n]->quantval));
+	cinfo->quant_tbl_ptrs[n]->sent_table = FALSE;
+	return 0;
+}
+
+static int start_coefficients(j_compress_ptr cinfo, JDIMENSION *widths, JDIMENSION *heights, jvirt_barray_ptr **arrays) {
+	// handle error
+	struct my_error_mgr *err = (struct my_error_mgr *)cinfo->err;
+	if (setjmp(err->jmpbuf) != 0) {
+		return err->pub.msg_code;
+	}
+
+	// The arrays must live until jpeg_finish_compress reads them.
+	*arrays = (*cinfo->mem->alloc_small)((j_common_ptr)cinfo, JPOOL_IMAGE, sizeof(jvirt_barray_ptr) * cinfo->num_components);
+	int ci;
+	for (ci = 0; ci < cinfo->num_components; ci++) {
+		(*arrays)[ci] = (*cinfo->mem->request_virt_barray)((j_common_ptr)cinfo, JPOOL_IMAGE, TRUE,
+			widths[ci], heights[ci], cinfo->comp_info[ci].v_samp_factor);
+	}
+	jpeg_write_coefficients(cinfo, *arrays);
+	return 0;
+}
+
+static int write_marker(j_compress_ptr cinfo, int code, const JOCTET *data, unsigned int length) {
+	// handle error
+	struct my_error_mgr *err = (struct my_error_mgr *)cinfo->err;
+	if (setjmp(err->jmpbuf) != 0) {
+		return err->pub.msg_code;
+	}
+
+	jpeg_write_marker(cinfo, code, data, length);
+	return 0;
+}
+
+static jvirt_barray_ptr barray_at(jvirt_barray_ptr *arrays, int i) {
+	return arrays[i];
+}
+
+*/
+import "C"
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"unsafe"
+)
+
+// ColorSpace is the color space of the components of a JPEG image.
+type ColorSpace C.J_COLOR_SPACE
+
+const (
+	// ColorSpaceUnknown is an unspecified color space.
+	ColorSpaceUnknown ColorSpace = C.JCS_UNKNOWN
+	// ColorSpaceGrayscale is monochrome.
+	ColorSpaceGrayscale ColorSpace = C.JCS_GRAYSCALE
+	// ColorSpaceRGB is red, green and blue.
+	ColorSpaceRGB ColorSpace = C.JCS_RGB
+	// ColorSpaceYCbCr is luma and chroma, the usual color space of JPEG.
+	ColorSpaceYCbCr ColorSpace = C.JCS_YCbCr
+	// ColorSpaceCMYK is cyan, magenta, yellow and black.
+	ColorSpaceCMYK ColorSpace = C.JCS_CMYK
+	// ColorSpaceYCCK is CMYK with the CMY part converted to YCbCr.
+	ColorSpaceYCCK ColorSpace = C.JCS_YCCK
+)
+
+// Marker codes of the markers kept in Coefficients.Markers.
+const (
+	MarkerAPP0 = C.JPEG_APP0 // MarkerAPP0 is the code of APP0; APPn is MarkerAPP0+n.
+	MarkerCOM  = C.JPEG_COM  // MarkerCOM is the code of a comment.
+)
+
+// MarkerCopy specifies which markers are carried over by the lossless
+// operations.
+type MarkerCopy int
+
+const (
+	// CopyComments keeps COM markers. It is the default, as in jpegtran.
+	CopyComments MarkerCopy = iota
+	// CopyNone drops all extra markers.
+	CopyNone
+	// CopyAll keeps COM and APPn markers, such as Exif and ICC profiles.
+	CopyAll
+)
+
+// Marker is an APPn or COM marker of a JPEG image.
+type Marker struct {
+	Code int    // Code is MarkerCOM or MarkerAPP0+n.
+	Data []byte // Data is the contents of the marker without its length.
+}
+
+// Block holds the 64 quantized DCT coefficients of an 8x8 block in natural
+// (row-major) order, not in the zigzag order of the file.
+type Block [C.DCTSIZE2]int16
+
+// Component holds the quantized DCT blocks of an image component.
+type Component struct {
+	ID          int // ID is the component identifier.
+	HSampFactor int // HSampFactor is the horizontal sampling factor.
+	VSampFactor int // VSampFactor is the vertical sampling factor.
+	QuantTable  int // QuantTable is the index of the quantization table in Coefficients.QuantTables.
+
+	// Blocks holds a grid of WidthInBlocks x HeightInBlocks blocks row by
+	// row. The grid is padded to whole iMCUs, so it may extend past the
+	// image; see BlockGrid.
+	WidthInBlocks, HeightInBlocks int
+	Blocks                        []Block
+}
+
+// Block returns the block at (x, y) of the grid.
+func (c *Component) Block(x, y int) *Block {
+	return &c.Blocks[y*c.WidthInBlocks+x]
+}
+
+// Coefficients holds a JPEG image as its quantized DCT coefficients.
+type Coefficients struct {
+	Width, Height int
+	ColorSpace    ColorSpace
+	Components    []Component
+	QuantTables   [C.NUM_QUANT_TBLS][]uint16 // QuantTables are in natural order, nil if not defined.
+	Progressive   bool                       // Progressive tells whether the image was progressive.
+	Markers       []Marker                   // Markers are the APPn and COM markers in file order.
+
+	// JFIF tells whether the image had a JFIF marker. Its density is then
+	// kept in the JFIF marker libjpeg writes for grayscale and YCbCr images.
+	JFIF               bool
+	DensityUnit        int
+	XDensity, YDensity int
+}
+
+// iMCUSize returns the size of an iMCU in pixels.
+func (c *Coefficients) iMCUSize() (w, h int) {
+	maxH, maxV := c.maxSamp()
+	return maxH * C.DCTSIZE, maxV * C.DCTSIZE
+}
+
+func (c *Coefficients) maxSamp() (maxH, maxV int) {
+	for _, comp := range c.Components {
+		if comp.HSampFactor > maxH {
+			maxH = comp.HSampFactor
+		}
+		if comp.VSampFactor > maxV {
+			maxV = comp.VSampFactor
+		}
+	}
+	return
+}
+
+// BlockGrid returns the size of the block grid of component i, padded to
+// whole iMCUs like libjpeg's virtual block arrays.
+func (c *Coefficients) BlockGrid(i int) (width, height int) {
+	maxH, maxV := c.maxSamp()
+	comp := &c.Components[i]
+	return blockGrid(c.Width, c.Height, comp.HSampFactor, comp.VSampFactor, maxH, maxV)
+}
+
+func blockGrid(width, height, hSamp, vSamp, maxH, maxV int) (w, h int) {
+	w = (width*hSamp + maxH*C.DCTSIZE - 1) / (maxH * C.DCTSIZE)
+	h = (height*vSamp + maxV*C.DCTSIZE - 1) / (maxV * C.DCTSIZE)
+	return padMultiple(w, hSamp), padMultiple(h, vSamp)
+}
+
+// padMultiple rounds a up to a multiple of b.
+func padMultiple(a, b int) int {
+	return (a + b - 1) / b * b
+}
+
+// Allocate sets up the block grids of every component for the image size,
+// with all coefficients zero.
+func (c *Coefficients) Allocate() {
+	for i := range c.Components {
+		comp := &c.Components[i]
+		comp.WidthInBlocks, comp.HeightInBlocks = c.BlockGrid(i)
+		comp.Blocks = make([]Block, comp.WidthInBlocks*comp.HeightInBlocks)
+	}
+}
+
+// validate checks that c can be handed to libjpeg.
+func (c *Coefficients) validate() error {
+	if c.Width <= 0 || c.Height <= 0 || c.Width > C.JPEG_MAX_DIMENSION || c.Height > C.JPEG_MAX_DIMENSION {
+		return fmt.Errorf("invalid image size: %dx%d", c.Width, c.Height)
+	}
+	if len(c.Components) == 0 || len(c.Components) > C.MAX_COMPONENTS {
+		return fmt.Errorf("unsupported number of components: %d", len(c.Components))
+	}
+	for i, comp := range c.Components {
+		if comp.HSampFactor < 1 || comp.HSampFactor > C.MAX_SAMP_FACTOR || comp.VSampFactor < 1 || comp.VSampFactor > C.MAX_SAMP_FACTOR {
+			return fmt.Errorf("invalid sampling factors of component %d", i)
+		}
+		if comp.QuantTable < 0 || comp.QuantTable >= len(c.QuantTables) || len(c.QuantTables[comp.QuantTable]) != C.DCTSIZE2 {
+			return fmt.Errorf("missing quantization table of component %d", i)
+		}
+		w, h := c.BlockGrid(i)
+		if comp.WidthInBlocks != w || comp.HeightInBlocks != h || len(comp.Blocks) != w*h {
+			return fmt.Errorf("block grid of component %d does not match the image size", i)
+		}
+	}
+	for i, table := range c.QuantTables {
+		if table == nil {
+			continue
+		}
+		if len(table) != C.DCTSIZE2 {
+			return fmt.Errorf("invalid quantization table %d", i)
+		}
+		for _, q := range table {
+			if q == 0 {
+				return fmt.Errorf("invalid quantization table %d", i)
+			}
+		}
+	}
+	return nil
+}
+
+// ReadCoefficients reads the quantized DCT coefficients of a JPEG image from
+// r without decoding its pixels. All APPn and COM markers are kept.
+func ReadCoefficients(r io.Reader) (*Coefficients, error) {
+	d := new(Decoder)
+	defer d.Close()
+	return d.ReadCoefficients(r)
+}
+
+// ReadCoefficients reads the quantized DCT coefficients of a JPEG image from
+// r without decoding its pixels. All APPn and COM markers are kept.
+func (d *Decoder) ReadCoefficients(r io.Reader) (*Coefficients, error) {
+	return d.readCoefficients(r, nil, CopyAll)
+}
+
+// readCoefficients reads the DCT coefficients of a JPEG image from r. Markers
+// are saved according to markers.
+func (d *Decoder) readCoefficients(r io.Reader, options *DecoderOptions, markers MarkerCopy) (c *Coefficients, err error) {
+	if options == nil {
+		options = &DecoderOptions{}
+	}
+	err = d.begin(context.Background(), r, options)
+	if err != nil {
+		return nil, err
+	}
+	defer d.end()
+	defer func() { err = d.limitError(err, options) }()
+	dinfo := d.dinfo
+
+	C.save_markers(dinfo, boolean(markers != CopyNone), boolean(markers == CopyAll))
+	defer C.save_markers(dinfo, C.FALSE, C.FALSE)
+
+	err = readHeader(dinfo)
+	if err != nil {
+		return nil, err
+	}
+	err = checkLimits(dinfo, options)
+	if err != nil {
+		return nil, err
+	}
+
+	var arrays *C.jvirt_barray_ptr
+	if C.read_coefficients(dinfo, &arrays) != 0 {
+		return nil, errors.New(jpegErrorMessage(unsafe.Pointer(dinfo)))
+	}
+
+	c = &Coefficients{
+		Width:       int(dinfo.image_width),
+		Height:      int(dinfo.image_height),
+		ColorSpace:  ColorSpace(dinfo.jpeg_color_space),
+		Progressive: dinfo.progressive_mode != 0,
+		Components:  make([]Component, dinfo.num_components),
+	}
+	if dinfo.saw_JFIF_marker != 0 {
+		c.JFIF = true
+		c.DensityUnit = int(dinfo.density_unit)
+		c.XDensity, c.YDensity = int(dinfo.X_density), int(dinfo.Y_density)
+	}
+	compInfo := unsafe.Slice(dinfo.comp_info, dinfo.num_components)
+	for i := range c.Components {
+		comp := &c.Components[i]
+		comp.ID = int(compInfo[i].component_id)
+		comp.HSampFactor, comp.VSampFactor = int(compInfo[i].h_samp_factor), int(compInfo[i].v_samp_factor)
+		comp.QuantTable = int(compInfo[i].quant_tbl_no)
+		if len(c.Components) == 1 {
+			// libjpeg ignores the sampling factors of single component
+			// images.
+			comp.HSampFactor, comp.VSampFactor = 1, 1
+		}
+	}
+	c.Allocate()
+	for i := range c.Components {
+		comp := &c.Components[i]
+		array := C.barray_at(arrays, C.int(i))
+		if C.copy_blocks(C.j_common_ptr(unsafe.Pointer(dinfo)), array, (*C.JCOEF)(unsafe.Pointer(&comp.Blocks[0])), C.JDIMENSION(comp.WidthInBlocks), C.JDIMENSION(comp.HeightInBlocks), C.FALSE) != 0 {
+			return nil, errors.New(jpegErrorMessage(unsafe.Pointer(dinfo)))
+		}
+	}
+	for i, table := range dinfo.quant_tbl_ptrs {
+		if table != nil {
+			c.QuantTables[i] = make([]uint16, C.DCTSIZE2)
+			for k, v := range table.quantval {
+				c.QuantTables[i][k] = uint16(v)
+			}
+		}
+	}
+	for m := dinfo.marker_list; m != nil; m = m.next {
+		c.Markers = append(c.Markers, Marker{
+			Code: int(m.marker),
+			Data: C.GoBytes(unsafe.Pointer(m.data), C.int(m.data_length)),
+		})
+	}
+	return c, nil
+}
+
+func boolean(b bool) C.boolean {
+	if b {
+		return C.TRUE
+	}
+	return C.FALSE
+}
+
+// CoefficientOptions specifies how coefficients are written.
+type CoefficientOptions struct {
+	ProgressiveMode bool // If true, write a progressive image.
+	OptimizeCoding  bool // If true, compute optimal Huffman tables.
+	Arithmetic      bool // If true, use arithmetic coding instead of Huffman coding.
+}
+
+// WriteCoefficients writes c into w as a JPEG image without any quantization
+// or DCT, so that the coefficients are stored exactly. The critical
+// parameters (size, color space, components and quantization tables) are
+// taken from c as jpeg_copy_critical_parameters does, and c.Markers are
+// written after the JFIF or Adobe marker libjpeg writes itself.
+//
+// If options is nil, the progression of c is kept and the Huffman tables are
+// optimized.
+func WriteCoefficients(w io.Writer, c *Coefficients, options *CoefficientOptions) error {
+	e := new(Encoder)
+	defer e.Close()
+	return e.WriteCoefficients(w, c, options)
+}
+
+// WriteCoefficients writes c into w as a JPEG image without any quantization
+// or DCT, so that the coefficients are stored exactly.
+func (e *Encoder) WriteCoefficients(w io.Writer, c *Coefficients, options *CoefficientOptions) error {
+	if w == nil {
+		return errors.New("nil writer")
+	}
+	if options == nil {
+		options = &CoefficientOptions{ProgressiveMode: c.Progressive, OptimizeCoding: true}
+	}
+	return e.writeCoefficients(w, c, options)
+}
+
+// writeCoefficients writes c as a JPEG image into w, or into memory if w is
+// nil.
+func (e *Encoder) writeCoefficients(w io.Writer, c *Coefficients, options *CoefficientOptions) (err error) {
+	if err = c.validate(); err != nil {
+		return err
+	}
+	err = e.begin(w, &EncoderOptions{})
+	if err != nil {
+		return err
+	}
+	defer e.end()
+	cinfo := e.cinfo
+
+	if C.setup_coefficients(cinfo, C.J_COLOR_SPACE(c.ColorSpace), C.int(len(c.Components))) != 0 {
+		return errors.New(jpegErrorMessage(unsafe.Pointer(cinfo)))
+	}
+	resetHuffTables(cinfo)
+	if int(cinfo.num_components) != len(c.Components) {
+		return errors.New("unsupported number of components for the color space")
+	}
+	cinfo.image_width = C.JDIMENSION(c.Width)
+	cinfo.image_height = C.JDIMENSION(c.Height)
+	for i, table := range c.QuantTables {
+		if table == nil {
+			continue
+		}
+		if C.set_quant_table(cinfo, C.int(i), (*C.UINT16)(unsafe.Pointer(&table[0]))) != 0 {
+			return errors.New(jpegErrorMessage(unsafe.Pointer(cinfo)))
+		}
+	}
+	compInfo := unsafe.Slice(cinfo.comp_info, cinfo.num_components)
+	widths := make([]C.JDIMENSION, len(c.Components))
+	heights := make([]C.JDIMENSION, len(c.Components))
+	for i, comp := range c.Components {
+		compInfo[i].component_id = C.int(comp.ID)
+		compInfo[i].h_samp_factor = C.int(comp.HSampFactor)
+		compInfo[i].v_samp_factor = C.int(comp.VSampFactor)
+		compInfo[i].quant_tbl_no = C.int(comp.QuantTable)
+		widths[i], heights[i] = C.JDIMENSION(comp.WidthInBlocks), C.JDIMENSION(comp.HeightInBlocks)
+	}
+	if c.JFIF {
+		cinfo.density_unit = C.UINT8(c.DensityUnit)
+		cinfo.X_density, cinfo.Y_density = C.UINT16(c.XDensity), C.UINT16(c.YDensity)
+	}
+	if options.ProgressiveMode {
+		C.jpeg_simple_progression(cinfo)
+	}
+	cinfo.optimize_coding = boolean(options.OptimizeCoding)
+	cinfo.arith_code = boolean(options.Arithmetic)
+
+	var arrays *C.jvirt_barray_ptr
+	if C.start_coefficients(cinfo, &widths[0], &heights[0], &arrays) != 0 {
+		return errors.New(jpegErrorMessage(unsafe.Pointer(cinfo)))
+	}
+	for i, comp := range c.Components {
+		array := C.barray_at(arrays, C.int(i))
+		if C.copy_blocks(C.j_common_ptr(unsafe.Pointer(cinfo)), array, (*C.JCOEF)(unsafe.Pointer(&comp.Blocks[0])), C.JDIMENSION(comp.WidthInBlocks), C.JDIMENSION(comp.HeightInBlocks), C.TRUE) != 0 {
+			return errors.New(jpegErrorMessage(unsafe.Pointer(cinfo)))
+		}
+	}
+	for _, m := range c.Markers {
+		if skipMarker(cinfo, m) {
+			continue
+		}
+		if m.Code != MarkerCOM && (m.Code < MarkerAPP0 || m.Code > MarkerAPP0+15) {
+			return fmt.Errorf("unsupported marker: %#x", m.Code)
+		}
+		if len(m.Data) > 65533 {
+			return errors.New("marker too long")
+		}
+		var data *C.JOCTET
+		if len(m.Data) > 0 {
+			data = (*C.JOCTET)(unsafe.Pointer(&m.Data[0]))
+		}
+		if C.write_marker(cinfo, C.int(m.Code), data, C.uint(len(m.Data))) != 0 {
+			return errors.New(jpegErrorMessage(unsafe.Pointer(cinfo)))
+		}
+	}
+	return finishCompress(cinfo)
+}
+
+// skipMarker reports whether m duplicates a JFIF or Adobe marker libjpeg
+// writes by itself.
+func skipMarker(cinfo *C.struct_jpeg_compress_struct, m Marker) bool {
+	switch {
+	case m.Code == MarkerAPP0 && cinfo.write_JFIF_header != 0:
+		return bytes.HasPrefix(m.Data, []byte("JFIF\x00"))
+	case m.Code == MarkerAPP0+14 && cinfo.write_Adobe_marker != 0:
+		return bytes.HasPrefix(m.Data, []byte("Adobe"))
+	}
+	return false
+}
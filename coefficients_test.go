@@ -0,0 +1,103 @@
+package jpeg
+
+import (
+	"bytes"
+	"image"
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+func TestReadCoefficients(t *testing.T) {
+	data, err := ioutil.ReadFile("images/kinkaku.jpg")
+	if err != nil {
+		t.Fatalf("reading file: %v", err)
+	}
+	c, err := ReadCoefficients(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("ReadCoefficients returns error: %v", err)
+	}
+	if c.Width != 1024 || c.Height != 768 || c.ColorSpace != ColorSpaceYCbCr || len(c.Components) != 3 {
+		t.Fatalf("got %dx%d, color space %d, %d components", c.Width, c.Height, c.ColorSpace, len(c.Components))
+	}
+	for i, comp := range c.Components {
+		w, h := c.BlockGrid(i)
+		if comp.WidthInBlocks != w || comp.HeightInBlocks != h || len(comp.Blocks) != w*h {
+			t.Errorf("component %d: got %dx%d blocks (%d), want %dx%d", i, comp.WidthInBlocks, comp.HeightInBlocks, len(comp.Blocks), w, h)
+		}
+		if c.QuantTables[comp.QuantTable] == nil {
+			t.Errorf("component %d: missing quantization table %d", i, comp.QuantTable)
+		}
+	}
+
+	for _, file := range []string{"images/kinkaku.jpg", "images/testdata/video-001.q50.410.progressive.jpeg", "images/testdata/video-005.gray.q50.2x2.jpeg", "images/testdata/video-001.cmyk.jpeg"} {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatalf("reading file: %v", err)
+		}
+		c, err := ReadCoefficients(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("%s: ReadCoefficients returns error: %v", file, err)
+		}
+		var out bytes.Buffer
+		if err := WriteCoefficients(&out, c, nil); err != nil {
+			t.Fatalf("%s: WriteCoefficients returns error: %v", file, err)
+		}
+		c2, err := ReadCoefficients(&out)
+		if err != nil {
+			t.Fatalf("%s: reading written coefficients returns error: %v", file, err)
+		}
+		if !reflect.DeepEqual(c.Components, c2.Components) || !reflect.DeepEqual(c.QuantTables, c2.QuantTables) {
+			t.Errorf("%s: coefficients changed by a round trip", file)
+		}
+		if c2.Progressive != c.Progressive || c2.ColorSpace != c.ColorSpace {
+			t.Errorf("%s: got progressive %v and color space %d, want %v and %d", file, c2.Progressive, c2.ColorSpace, c.Progressive, c.ColorSpace)
+		}
+	}
+}
+
+func TestWriteCoefficients(t *testing.T) {
+	c := &Coefficients{
+		Width:      16,
+		Height:     16,
+		ColorSpace: ColorSpaceGrayscale,
+		Components: []Component{{ID: 1, HSampFactor: 1, VSampFactor: 1}},
+	}
+	c.QuantTables[0] = make([]uint16, 64)
+	for i := range c.QuantTables[0] {
+		c.QuantTables[0][i] = 1
+	}
+	c.Allocate()
+	// A horizontal frequency only changes the pixels along a row.
+	block := c.Components[0].Block(1, 0)
+	block[0] = 0
+	block[1] = 200
+
+	var out bytes.Buffer
+	if err := WriteCoefficients(&out, c, &CoefficientOptions{}); err != nil {
+		t.Fatalf("WriteCoefficients returns error: %v", err)
+	}
+	img, err := Decode(&out, nil)
+	if err != nil {
+		t.Fatalf("Decode returns error: %v", err)
+	}
+	gray, ok := img.(*image.Gray)
+	if !ok {
+		t.Fatalf("got %T, want *image.Gray", img)
+	}
+	for y := 0; y < 8; y++ {
+		for x := 8; x < 16; x++ {
+			if gray.GrayAt(x, y) != gray.GrayAt(x, 0) {
+				t.Fatalf("pixel (%d, %d) differs from its column", x, y)
+			}
+		}
+	}
+	if gray.GrayAt(8, 0).Y <= gray.GrayAt(15, 0).Y || gray.GrayAt(0, 0).Y != 128 {
+		t.Errorf("got %v, %v and %v", gray.GrayAt(0, 0), gray.GrayAt(8, 0), gray.GrayAt(15, 0))
+	}
+
+	c.Components[0].Blocks = c.Components[0].Blocks[1:]
+	if err := WriteCoefficients(ioutil.Discard, c, nil); err == nil {
+		t.Errorf("WriteCoefficients with a short block grid returns no error")
+	}
+}
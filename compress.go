@@ -27,6 +27,19 @@ static struct jpeg_compress_struct *new_compress(void) {
 	}
 	jpeg_create_compress(cinfo);
 
+	// Keep a copy of the standard Huffman tables 0 and 1 in client_data:
+	// jpeg_set_defaults does not restore them once optimized coding has
+	// overwritten them in place.
+	cinfo->in_color_space = JCS_GRAYSCALE;
+	cinfo->input_components = 1;
+	jpeg_set_defaults(cinfo);
+	JHUFF_TBL *std = (JHUFF_TBL *)(*cinfo->mem->alloc_small)((j_common_ptr)cinfo, JPOOL_PERMANENT, sizeof(JHUFF_TBL) * 4);
+	std[0] = *cinfo->dc_huff_tbl_ptrs[0];
+	std[1] = *cinfo->dc_huff_tbl_ptrs[1];
+	std[2] = *cinfo->ac_huff_tbl_ptrs[0];
+	std[3] = *cinfo->ac_huff_tbl_ptrs[1];
+	cinfo->client_data = std;
+
 	return cinfo;
 }
 
@@ -36,6 +49,16 @@ static void destroy_compress(struct jpeg_compress_struct *cinfo) {
 	free(cinfo);
 }
 
+// reset_huff_tables restores the standard Huffman tables saved by
+// new_compress.
+static void reset_huff_tables(j_compress_ptr cinfo) {
+	JHUFF_TBL *std = (JHUFF_TBL *)cinfo->client_data;
+	*cinfo->dc_huff_tbl_ptrs[0] = std[0];
+	*cinfo->dc_huff_tbl_ptrs[1] = std[1];
+	*cinfo->ac_huff_tbl_ptrs[0] = std[2];
+	*cinfo->ac_huff_tbl_ptrs[1] = std[3];
+}
+
 static JDIMENSION write_scanlines(j_compress_ptr cinfo, JSAMPROW row, JDIMENSION max_lines, int *msg_code) {
 	// handle error
 	struct my_error_mgr *err = (struct my_error_mgr *)cinfo->err;
@@ -76,7 +99,7 @@ static JDIMENSION write_mcu_gray(struct jpeg_compress_struct *cinfo, JSAMPROW pi
 	return jpeg_write_raw_data(cinfo, &rows, height);
 }
 
-static JDIMENSION write_mcu_ycbcr(struct jpeg_compress_struct *cinfo, JSAMPROW y_row, JSAMPROW cb_row, JSAMPROW cr_row, int y_stride, int c_stride, int *msg_code) {
+static JDIMENSION write_mcu_ycbcr(struct jpeg_compress_struct *cinfo, JSAMPROW y_row, JSAMPROW cb_row, JSAMPROW cr_row, int y_stride, int cb_stride, int cr_stride, int *msg_code) {
 	// handle error
 	struct my_error_mgr *err = (struct my_error_mgr *)cinfo->err;
 	if (setjmp(err->jmpbuf) != 0) {
@@ -101,8 +124,8 @@ static JDIMENSION write_mcu_ycbcr(struct jpeg_compress_struct *cinfo, JSAMPROW y
 	}
 
 	for (h = 0; h < c_h; h++) {
-		cb_rows[h] = &cb_row[c_stride * h];
-		cr_rows[h] = &cr_row[c_stride * h];
+		cb_rows[h] = &cb_row[cb_stride * h];
+		cr_rows[h] = &cr_row[cr_stride * h];
 	}
 
 	// Get the data
@@ -140,9 +163,13 @@ static int finish_compress(j_compress_ptr cinfo)
 import "C"
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"image"
+	"image/color"
 	"io"
+	"runtime"
 	"unsafe"
 )
 
@@ -152,17 +179,74 @@ type EncoderOptions struct {
 	OptimizeCoding  bool
 	ProgressiveMode bool
 	DCTMethod       DCTMethod
+	WriteBufferSize int          // WriteBufferSize is the size of the write buffer (DefaultBufferSize if 0).
+	Progress        ProgressFunc // Progress is called with progress reports if not nil.
+	Background      color.Color  // Background is the color translucent pixels are composited onto (white if nil).
+	YCCK            bool         // If true, *image.CMYK is written as YCCK instead of CMYK, which compresses better.
+}
+
+// Encoder encodes JPEG images while keeping its libjpeg compressor and
+// destination buffers alive between calls, which saves the setup cost when
+// many images are encoded in a row.
+//
+// An Encoder may be reused sequentially but must not be used by multiple
+// goroutines at the same time.
+type Encoder struct {
+	cinfo    *C.struct_jpeg_compress_struct
+	dest     *destinationManager
+	progress *C.struct_go_progress_mgr
 }
 
-func newCompress(w io.Writer) (cinfo *C.struct_jpeg_compress_struct, err error) {
-	cinfo = C.new_compress()
-	if cinfo == nil {
-		err = errors.New("failed to allocate jpeg encoder")
+// NewEncoder returns a new Encoder. The libjpeg resources are allocated on
+// first use and released by Close.
+func NewEncoder() *Encoder {
+	e := new(Encoder)
+	runtime.SetFinalizer(e, (*Encoder).Close)
+	return e
+}
+
+// Close releases the resources held by e. e must not be used after Close.
+func (e *Encoder) Close() {
+	runtime.SetFinalizer(e, nil)
+	if e.cinfo == nil {
 		return
 	}
+	releaseDestinationManager(e.dest)
+	C.destroy_compress(e.cinfo)
+	releaseProgress(e.progress)
+	e.cinfo, e.dest, e.progress = nil, nil, nil
+}
 
-	_, err = makeDestinationManager(w, cinfo)
-	return
+// begin prepares the compressor to write a new image into w with options.
+// If w is nil, the image is written into memory.
+func (e *Encoder) begin(w io.Writer, options *EncoderOptions) error {
+	if e.cinfo == nil {
+		cinfo := C.new_compress()
+		if cinfo == nil {
+			return errors.New("failed to allocate jpeg encoder")
+		}
+		dest, err := makeDestinationManager(cinfo)
+		if err != nil {
+			C.destroy_compress(cinfo)
+			return err
+		}
+		e.cinfo, e.dest = cinfo, dest
+	}
+	if err := attachDestinationManager(e.dest, w, bufferSize(options.WriteBufferSize)); err != nil {
+		return err
+	}
+	if err := attachProgress(unsafe.Pointer(e.cinfo), &e.progress, options.Progress, 0); err != nil {
+		detachDestinationManager(e.dest)
+		return err
+	}
+	return nil
+}
+
+// end resets the compressor so that it can be used for the next image.
+func (e *Encoder) end() {
+	C.jpeg_abort_compress(e.cinfo)
+	detachDestinationManager(e.dest)
+	detachProgress(unsafe.Pointer(e.cinfo), e.progress)
 }
 
 func startCompress(cinfo *C.struct_jpeg_compress_struct) error {
@@ -173,17 +257,6 @@ func startCompress(cinfo *C.struct_jpeg_compress_struct) error {
 	return nil
 }
 
-func destroyCompress(cinfo *C.struct_jpeg_compress_struct) {
-	if cinfo == nil {
-		return
-	}
-	destinationManager := getDestinationManager(cinfo)
-	if destinationManager != nil {
-		releaseDestinationManager(destinationManager)
-	}
-	C.destroy_compress(cinfo)
-}
-
 func finishCompress(cinfo *C.struct_jpeg_compress_struct) error {
 	code := C.finish_compress(cinfo)
 	if code != 0 {
@@ -210,9 +283,9 @@ func writeMCUGray(cinfo *C.struct_jpeg_compress_struct, row C.JSAMPROW, stride i
 	return
 }
 
-func writeMCUYCbCr(cinfo *C.struct_jpeg_compress_struct, y, cb, cr C.JSAMPROW, yStride, cStride int) (line int, err error) {
+func writeMCUYCbCr(cinfo *C.struct_jpeg_compress_struct, y, cb, cr C.JSAMPROW, yStride, cbStride, crStride int) (line int, err error) {
 	code := C.int(0)
-	line = int(C.write_mcu_ycbcr(cinfo, y, cb, cr, C.int(yStride), C.int(cStride), &code))
+	line = int(C.write_mcu_ycbcr(cinfo, y, cb, cr, C.int(yStride), C.int(cbStride), C.int(crStride), &code))
 	if code != 0 {
 		err = errors.New(jpegErrorMessage(unsafe.Pointer(cinfo)))
 	}
@@ -221,37 +294,110 @@ func writeMCUYCbCr(cinfo *C.struct_jpeg_compress_struct, y, cb, cr C.JSAMPROW, y
 
 // Encode encodes src image and writes into w as JPEG format data.
 func Encode(w io.Writer, src image.Image, options *EncoderOptions) (err error) {
-	var cinfo *C.struct_jpeg_compress_struct
-	cinfo, err = newCompress(w)
+	e := new(Encoder)
+	defer e.Close()
+	return e.Encode(w, src, options)
+}
+
+// EncodeContext is like Encode but gives up encoding once ctx is done.
+// The returned error then wraps ctx.Err().
+func EncodeContext(ctx context.Context, w io.Writer, src image.Image, options *EncoderOptions) (err error) {
+	e := new(Encoder)
+	defer e.Close()
+	return e.EncodeContext(ctx, w, src, options)
+}
+
+// Encode encodes src image and writes into w as JPEG format data.
+func (e *Encoder) Encode(w io.Writer, src image.Image, options *EncoderOptions) (err error) {
+	return e.EncodeContext(context.Background(), w, src, options)
+}
+
+// EncodeContext is like Encode but gives up encoding once ctx is done.
+// The returned error then wraps ctx.Err().
+func (e *Encoder) EncodeContext(ctx context.Context, w io.Writer, src image.Image, options *EncoderOptions) (err error) {
+	if err = canceled(ctx, "encoding"); err != nil {
+		return
+	}
+	if w == nil {
+		return errors.New("nil writer")
+	}
+	if options == nil {
+		options = &EncoderOptions{Quality: 75}
+	}
+	err = e.begin(w, options)
 	if err != nil {
 		return
 	}
-	defer destroyCompress(cinfo)
+	defer e.end()
+	return encode(ctx, e.cinfo, src, options)
+}
+
+// EncodeToBytes encodes src image and returns JPEG format data.
+func EncodeToBytes(src image.Image, options *EncoderOptions) ([]byte, error) {
+	return AppendEncode(nil, src, options)
+}
+
+// AppendEncode encodes src image and appends JPEG format data to dst.
+// The data is collected in memory and copied into dst once at the end.
+func AppendEncode(dst []byte, src image.Image, options *EncoderOptions) ([]byte, error) {
+	e := new(Encoder)
+	defer e.Close()
+	return e.AppendEncode(dst, src, options)
+}
 
+// AppendEncode encodes src image and appends JPEG format data to dst.
+// The data is collected in memory and copied into dst once at the end.
+func (e *Encoder) AppendEncode(dst []byte, src image.Image, options *EncoderOptions) ([]byte, error) {
 	if options == nil {
 		options = &EncoderOptions{Quality: 75}
 	}
+	err := e.begin(nil, options)
+	if err != nil {
+		return dst, err
+	}
+	defer e.end()
+	err = encode(context.Background(), e.cinfo, src, options)
+	if err != nil {
+		return dst, err
+	}
+	return append(dst, memoryBytes(e.dest)...), nil
+}
 
+func encode(ctx context.Context, cinfo *C.struct_jpeg_compress_struct, src image.Image, options *EncoderOptions) (err error) {
 	switch s := src.(type) {
 	case *image.YCbCr:
-		err = encodeYCbCr(cinfo, s, options)
+		err = encodeYCbCr(ctx, cinfo, s, options)
 	case *image.Gray:
-		err = encodeGray(cinfo, s, options)
+		err = encodeGray(ctx, cinfo, s, options)
 	case *image.RGBA:
-		err = encodeRGBA(cinfo, s, options)
+		if s.Opaque() {
+			err = encodeRGBA(ctx, cinfo, s, options)
+		} else {
+			// libjpeg would just drop the alpha channel.
+			err = encodeRows(ctx, cinfo, s, options)
+		}
 	case *RGB:
-		err = encodeRGB(cinfo, s, options)
+		err = encodeRGB(ctx, cinfo, s, options)
+	case *image.CMYK:
+		err = encodeCMYK(ctx, cinfo, s, options)
 	default:
-		return errors.New("unsupported image type")
+		err = encodeRows(ctx, cinfo, src, options)
 	}
 
 	return
 }
 
 // encode image.YCbCr
-func encodeYCbCr(cinfo *C.struct_jpeg_compress_struct, src *image.YCbCr, p *EncoderOptions) (err error) {
+func encodeYCbCr(ctx context.Context, cinfo *C.struct_jpeg_compress_struct, src *image.YCbCr, p *EncoderOptions) (err error) {
+	// The planes are read from the origin of the chroma samples, so a
+	// sub-image which starts within a chroma sample is re-sited first.
+	if hDiv, vDiv := subsampleDivisors(src.SubsampleRatio); src.Rect.Min.X%hDiv != 0 || src.Rect.Min.Y%vDiv != 0 {
+		src = alignYCbCr(src)
+	}
+
 	// Set up compression parameters
-	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
 	cinfo.image_width = C.JDIMENSION(w)
 	cinfo.image_height = C.JDIMENSION(h)
 	cinfo.input_components = 3
@@ -260,7 +406,6 @@ func encodeYCbCr(cinfo *C.struct_jpeg_compress_struct, src *image.YCbCr, p *Enco
 	setupEncoderOptions(cinfo, p)
 
 	compInfo := (*[3]C.jpeg_component_info)(unsafe.Pointer(cinfo.comp_info))
-	cVDiv := 1
 	switch src.SubsampleRatio {
 	case image.YCbCrSubsampleRatio444:
 		// 1x1,1x1,1x1
@@ -272,7 +417,6 @@ func encodeYCbCr(cinfo *C.struct_jpeg_compress_struct, src *image.YCbCr, p *Enco
 		compInfo[Y].h_samp_factor, compInfo[Y].v_samp_factor = 1, 2
 		compInfo[Cb].h_samp_factor, compInfo[Cb].v_samp_factor = 1, 1
 		compInfo[Cr].h_samp_factor, compInfo[Cr].v_samp_factor = 1, 1
-		cVDiv = 2
 	case image.YCbCrSubsampleRatio422:
 		// 2x1,1x1,1x1
 		compInfo[Y].h_samp_factor, compInfo[Y].v_samp_factor = 2, 1
@@ -283,7 +427,18 @@ func encodeYCbCr(cinfo *C.struct_jpeg_compress_struct, src *image.YCbCr, p *Enco
 		compInfo[Y].h_samp_factor, compInfo[Y].v_samp_factor = 2, 2
 		compInfo[Cb].h_samp_factor, compInfo[Cb].v_samp_factor = 1, 1
 		compInfo[Cr].h_samp_factor, compInfo[Cr].v_samp_factor = 1, 1
-		cVDiv = 2
+	case image.YCbCrSubsampleRatio411:
+		// 4x1,1x1,1x1
+		compInfo[Y].h_samp_factor, compInfo[Y].v_samp_factor = 4, 1
+		compInfo[Cb].h_samp_factor, compInfo[Cb].v_samp_factor = 1, 1
+		compInfo[Cr].h_samp_factor, compInfo[Cr].v_samp_factor = 1, 1
+	case image.YCbCrSubsampleRatio410:
+		// 4x2,1x1,1x1
+		compInfo[Y].h_samp_factor, compInfo[Y].v_samp_factor = 4, 2
+		compInfo[Cb].h_samp_factor, compInfo[Cb].v_samp_factor = 1, 1
+		compInfo[Cr].h_samp_factor, compInfo[Cr].v_samp_factor = 1, 1
+	default:
+		return fmt.Errorf("unsupported subsample ratio: %v", src.SubsampleRatio)
 	}
 
 	// libjpeg raw data in is in planar format, which avoids unnecessary
@@ -302,15 +457,29 @@ func encodeYCbCr(cinfo *C.struct_jpeg_compress_struct, src *image.YCbCr, p *Enco
 		}
 	}()
 
+	hDiv, vDiv := subsampleDivisors(src.SubsampleRatio)
+	cw, ch := (w+hDiv-1)/hDiv, (h+vDiv-1)/vDiv
+	yOff, cOff := src.YOffset(b.Min.X, b.Min.Y), src.COffset(b.Min.X, b.Min.Y)
+	yPlane := rawPlane{pix: src.Y[yOff:], stride: src.YStride, width: w, height: h, paddedWidth: int(compInfo[Y].width_in_blocks) * C.DCTSIZE}
+	cbPlane := rawPlane{pix: src.Cb[cOff:], stride: src.CStride, width: cw, height: ch, paddedWidth: int(compInfo[Cb].width_in_blocks) * C.DCTSIZE}
+	crPlane := rawPlane{pix: src.Cr[cOff:], stride: src.CStride, width: cw, height: ch, paddedWidth: int(compInfo[Cr].width_in_blocks) * C.DCTSIZE}
+	yRows, cRows := int(compInfo[Y].v_samp_factor)*C.DCTSIZE, int(compInfo[Cb].v_samp_factor)*C.DCTSIZE
+
 	for v := 0; v < h; {
-		yOff, cOff := v*src.YStride, v/cVDiv*src.CStride
+		if err = canceled(ctx, "encoding"); err != nil {
+			return
+		}
+		y, yStride := yPlane.input(v, yRows)
+		cb, cbStride := cbPlane.input(v/vDiv, cRows)
+		cr, crStride := crPlane.input(v/vDiv, cRows)
 		line, err := writeMCUYCbCr(
 			cinfo,
-			C.JSAMPROW(unsafe.Pointer(&src.Y[yOff])),
-			C.JSAMPROW(unsafe.Pointer(&src.Cb[cOff])),
-			C.JSAMPROW(unsafe.Pointer(&src.Cr[cOff])),
-			src.YStride,
-			src.CStride,
+			C.JSAMPROW(unsafe.Pointer(&y[0])),
+			C.JSAMPROW(unsafe.Pointer(&cb[0])),
+			C.JSAMPROW(unsafe.Pointer(&cr[0])),
+			yStride,
+			cbStride,
+			crStride,
 		)
 		if err != nil {
 			return err
@@ -320,10 +489,39 @@ func encodeYCbCr(cinfo *C.struct_jpeg_compress_struct, src *image.YCbCr, p *Enco
 	return
 }
 
+// alignYCbCr returns a copy of src at the origin, with each chroma sample
+// averaged from the chroma of the pixels it covers in src.
+func alignYCbCr(src *image.YCbCr) *image.YCbCr {
+	b := src.Bounds()
+	dst := image.NewYCbCr(image.Rect(0, 0, b.Dx(), b.Dy()), src.SubsampleRatio)
+	for y := 0; y < b.Dy(); y++ {
+		copy(dst.Y[y*dst.YStride:y*dst.YStride+b.Dx()], src.Y[src.YOffset(b.Min.X, b.Min.Y+y):])
+	}
+	hDiv, vDiv := subsampleDivisors(src.SubsampleRatio)
+	cw, ch := (b.Dx()+hDiv-1)/hDiv, (b.Dy()+vDiv-1)/vDiv
+	for cy := 0; cy < ch; cy++ {
+		for cx := 0; cx < cw; cx++ {
+			var cb, cr, n int
+			for y := cy * vDiv; y < (cy+1)*vDiv && y < b.Dy(); y++ {
+				for x := cx * hDiv; x < (cx+1)*hDiv && x < b.Dx(); x++ {
+					off := src.COffset(b.Min.X+x, b.Min.Y+y)
+					cb += int(src.Cb[off])
+					cr += int(src.Cr[off])
+					n++
+				}
+			}
+			dst.Cb[cy*dst.CStride+cx] = uint8((cb + n/2) / n)
+			dst.Cr[cy*dst.CStride+cx] = uint8((cr + n/2) / n)
+		}
+	}
+	return dst
+}
+
 // encode image.RGBA
-func encodeRGBA(cinfo *C.struct_jpeg_compress_struct, src *image.RGBA, p *EncoderOptions) (err error) {
+func encodeRGBA(ctx context.Context, cinfo *C.struct_jpeg_compress_struct, src *image.RGBA, p *EncoderOptions) (err error) {
 	// Set up compression parameters
-	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
 	cinfo.image_width = C.JDIMENSION(w)
 	cinfo.image_height = C.JDIMENSION(h)
 	cinfo.input_components = 4
@@ -347,7 +545,10 @@ func encodeRGBA(cinfo *C.struct_jpeg_compress_struct, src *image.RGBA, p *Encode
 	}()
 
 	for v := 0; v < h; {
-		line, err := writeScanline(cinfo, C.JSAMPROW(unsafe.Pointer(&src.Pix[v*src.Stride])), C.JDIMENSION(1))
+		if err = canceled(ctx, "encoding"); err != nil {
+			return
+		}
+		line, err := writeScanline(cinfo, C.JSAMPROW(unsafe.Pointer(&src.Pix[src.PixOffset(b.Min.X, b.Min.Y+v)])), C.JDIMENSION(1))
 		if err != nil {
 			return err
 		}
@@ -357,9 +558,10 @@ func encodeRGBA(cinfo *C.struct_jpeg_compress_struct, src *image.RGBA, p *Encode
 }
 
 // encode and rgb Image.
-func encodeRGB(cinfo *C.struct_jpeg_compress_struct, src *RGB, p *EncoderOptions) (err error) {
+func encodeRGB(ctx context.Context, cinfo *C.struct_jpeg_compress_struct, src *RGB, p *EncoderOptions) (err error) {
 	// Set up compression parameters
-	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
 	cinfo.image_width = C.JDIMENSION(w)
 	cinfo.image_height = C.JDIMENSION(h)
 	cinfo.input_components = 3
@@ -380,7 +582,10 @@ func encodeRGB(cinfo *C.struct_jpeg_compress_struct, src *RGB, p *EncoderOptions
 	}()
 
 	for v := 0; v < h; {
-		line, err := writeScanline(cinfo, C.JSAMPROW(unsafe.Pointer(&src.Pix[v*src.Stride])), C.JDIMENSION(1))
+		if err = canceled(ctx, "encoding"); err != nil {
+			return
+		}
+		line, err := writeScanline(cinfo, C.JSAMPROW(unsafe.Pointer(&src.Pix[src.PixOffset(b.Min.X, b.Min.Y+v)])), C.JDIMENSION(1))
 		if err != nil {
 			return err
 		}
@@ -390,9 +595,10 @@ func encodeRGB(cinfo *C.struct_jpeg_compress_struct, src *RGB, p *EncoderOptions
 }
 
 // encode image.Gray
-func encodeGray(cinfo *C.struct_jpeg_compress_struct, src *image.Gray, p *EncoderOptions) (err error) {
+func encodeGray(ctx context.Context, cinfo *C.struct_jpeg_compress_struct, src *image.Gray, p *EncoderOptions) (err error) {
 	// Set up compression parameters
-	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
 	cinfo.image_width = C.JDIMENSION(w)
 	cinfo.image_height = C.JDIMENSION(h)
 	cinfo.input_components = 1
@@ -419,8 +625,15 @@ func encodeGray(cinfo *C.struct_jpeg_compress_struct, src *image.Gray, p *Encode
 		}
 	}()
 
+	plane := rawPlane{pix: src.Pix[src.PixOffset(b.Min.X, b.Min.Y):], stride: src.Stride, width: w, height: h, paddedWidth: int(compInfo.width_in_blocks) * C.DCTSIZE}
+	rows := int(compInfo.v_samp_factor) * C.DCTSIZE
+
 	for v := 0; v < h; {
-		line, err := writeMCUGray(cinfo, C.JSAMPROW(unsafe.Pointer(&src.Pix[v*src.Stride])), src.Stride)
+		if err = canceled(ctx, "encoding"); err != nil {
+			return
+		}
+		pix, stride := plane.input(v, rows)
+		line, err := writeMCUGray(cinfo, C.JSAMPROW(unsafe.Pointer(&pix[0])), stride)
 		if err != nil {
 			return err
 		}
@@ -429,8 +642,206 @@ func encodeGray(cinfo *C.struct_jpeg_compress_struct, src *image.Gray, p *Encode
 	return
 }
 
+// encode image.CMYK
+func encodeCMYK(ctx context.Context, cinfo *C.struct_jpeg_compress_struct, src *image.CMYK, p *EncoderOptions) (err error) {
+	// Set up compression parameters
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	cinfo.image_width = C.JDIMENSION(w)
+	cinfo.image_height = C.JDIMENSION(h)
+	cinfo.input_components = 4
+	cinfo.in_color_space = C.JCS_CMYK
+
+	// libjpeg writes the Adobe marker for CMYK and YCCK images, with the
+	// transform flag matching the color space.
+	setupEncoderOptions(cinfo, p)
+
+	// Start compression
+	err = startCompress(cinfo)
+	if err != nil {
+		return
+	}
+	defer func() {
+		ferr := finishCompress(cinfo)
+		if ferr != nil && err == nil {
+			err = ferr
+		}
+	}()
+
+	// Adobe CMYK images store inverted inks, 0 being full coverage, as
+	// Photoshop writes them and image/jpeg reads them.
+	row := make([]uint8, w*4)
+	for v := 0; v < h; {
+		if err = canceled(ctx, "encoding"); err != nil {
+			return
+		}
+		pix := src.Pix[src.PixOffset(b.Min.X, b.Min.Y+v):]
+		for i := range row {
+			row[i] = 255 - pix[i]
+		}
+		line, err := writeScanline(cinfo, C.JSAMPROW(unsafe.Pointer(&row[0])), C.JDIMENSION(1))
+		if err != nil {
+			return err
+		}
+		v += line
+	}
+	return
+}
+
+// rowConverter fills row with the pixels of the row y of an image.
+type rowConverter func(row []uint8, y int)
+
+// encodeRows encodes any other image type, or an image with translucent
+// pixels, one scanline at a time, converting each row into a buffer so that
+// the image is never converted as a whole.
+func encodeRows(ctx context.Context, cinfo *C.struct_jpeg_compress_struct, src image.Image, p *EncoderOptions) (err error) {
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w <= 0 || h <= 0 {
+		return errors.New("empty image")
+	}
+	components, colorSpace, convert := newRowConverter(src, newBackground(p.Background))
+	cinfo.image_width = C.JDIMENSION(w)
+	cinfo.image_height = C.JDIMENSION(h)
+	cinfo.input_components = C.int(components)
+	cinfo.in_color_space = colorSpace
+
+	setupEncoderOptions(cinfo, p)
+
+	// Start compression
+	err = startCompress(cinfo)
+	if err != nil {
+		return
+	}
+	defer func() {
+		ferr := finishCompress(cinfo)
+		if ferr != nil && err == nil {
+			err = ferr
+		}
+	}()
+
+	row := make([]uint8, w*components)
+	for v := 0; v < h; {
+		if err = canceled(ctx, "encoding"); err != nil {
+			return
+		}
+		convert(row, b.Min.Y+v)
+		line, err := writeScanline(cinfo, C.JSAMPROW(unsafe.Pointer(&row[0])), C.JDIMENSION(1))
+		if err != nil {
+			return err
+		}
+		v += line
+	}
+	return
+}
+
+// newRowConverter returns the number of components and color space of the
+// rows of src, and a converter into them. The common types of the image
+// package are read directly; the others go through At. Translucent pixels are
+// composited onto bg.
+func newRowConverter(src image.Image, bg background) (int, C.J_COLOR_SPACE, rowConverter) {
+	b := src.Bounds()
+	switch s := src.(type) {
+	case *image.RGBA:
+		return 3, C.JCS_RGB, func(row []uint8, y int) {
+			pix := s.Pix[s.PixOffset(b.Min.X, y):]
+			for x := 0; x < b.Dx(); x++ {
+				p := pix[x*4 : x*4+4]
+				bg.composite(row[x*3:x*3+3], uint32(p[0])*0x101, uint32(p[1])*0x101, uint32(p[2])*0x101, uint32(p[3])*0x101)
+			}
+		}
+	case *image.NRGBA:
+		return 3, C.JCS_RGB, func(row []uint8, y int) {
+			pix := s.Pix[s.PixOffset(b.Min.X, y):]
+			for x := 0; x < b.Dx(); x++ {
+				p := pix[x*4 : x*4+4]
+				if p[3] == 0xff {
+					copy(row[x*3:x*3+3], p[:3])
+					continue
+				}
+				// Same rounding as color.NRGBA.RGBA.
+				a := uint32(p[3])
+				bg.composite(row[x*3:x*3+3], uint32(p[0])*0x101*a/0xff, uint32(p[1])*0x101*a/0xff, uint32(p[2])*0x101*a/0xff, a*0x101)
+			}
+		}
+	case *image.RGBA64:
+		return 3, C.JCS_RGB, func(row []uint8, y int) {
+			for x := 0; x < b.Dx(); x++ {
+				c := s.RGBA64At(b.Min.X+x, y)
+				bg.composite(row[x*3:x*3+3], uint32(c.R), uint32(c.G), uint32(c.B), uint32(c.A))
+			}
+		}
+	case *image.NRGBA64:
+		return 3, C.JCS_RGB, func(row []uint8, y int) {
+			for x := 0; x < b.Dx(); x++ {
+				r, g, bl, a := s.NRGBA64At(b.Min.X+x, y).RGBA()
+				bg.composite(row[x*3:x*3+3], r, g, bl, a)
+			}
+		}
+	case *image.Paletted:
+		// Indices past the end of the palette are black. Entries past 255
+		// cannot be indexed but are valid in a color.Palette.
+		palette := make([][3]uint8, max(256, len(s.Palette)))
+		for i, c := range s.Palette {
+			r, g, b, a := c.RGBA()
+			bg.composite(palette[i][:], r, g, b, a)
+		}
+		return 3, C.JCS_RGB, func(row []uint8, y int) {
+			pix := s.Pix[s.PixOffset(b.Min.X, y):]
+			for x := 0; x < b.Dx(); x++ {
+				copy(row[x*3:x*3+3], palette[pix[x]][:])
+			}
+		}
+	case *image.Gray16:
+		return 1, C.JCS_GRAYSCALE, func(row []uint8, y int) {
+			pix := s.Pix[s.PixOffset(b.Min.X, y):]
+			for x := 0; x < b.Dx(); x++ {
+				row[x] = pix[x*2]
+			}
+		}
+	}
+	return 3, C.JCS_RGB, func(row []uint8, y int) {
+		for x := 0; x < b.Dx(); x++ {
+			r, g, bl, a := src.At(b.Min.X+x, y).RGBA()
+			bg.composite(row[x*3:x*3+3], r, g, bl, a)
+		}
+	}
+}
+
+// background is the premultiplied 16-bit color translucent pixels are
+// composited onto, as JPEG has no alpha channel.
+type background [3]uint32
+
+func newBackground(c color.Color) background {
+	if c == nil {
+		c = color.White
+	}
+	r, g, b, _ := c.RGBA()
+	return background{r, g, b}
+}
+
+// composite writes the premultiplied 16-bit color r, g, b with alpha a over
+// bg into dst as 8-bit RGB.
+func (bg background) composite(dst []uint8, r, g, b, a uint32) {
+	t := 0xffff - a
+	dst[0] = uint8((r + bg[0]*t/0xffff) >> 8)
+	dst[1] = uint8((g + bg[1]*t/0xffff) >> 8)
+	dst[2] = uint8((b + bg[2]*t/0xffff) >> 8)
+}
+
+// resetHuffTables restores the standard Huffman tables after
+// jpeg_set_defaults, which keeps the optimized tables of a previous image
+// written by the same compressor.
+func resetHuffTables(cinfo *C.struct_jpeg_compress_struct) {
+	C.reset_huff_tables(cinfo)
+}
+
 func setupEncoderOptions(cinfo *C.struct_jpeg_compress_struct, opt *EncoderOptions) {
 	C.jpeg_set_defaults(cinfo)
+	resetHuffTables(cinfo)
+	if opt.YCCK && cinfo.in_color_space == C.JCS_CMYK {
+		C.jpeg_set_colorspace(cinfo, C.JCS_YCCK)
+	}
 	C.jpeg_set_quality(cinfo, C.int(opt.Quality), C.TRUE)
 	if opt.OptimizeCoding {
 		cinfo.optimize_coding = C.TRUE
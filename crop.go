@@ -0,0 +1,80 @@
+package jpeg
+
+import (
+	"errors"
+	"image"
+	"io"
+)
+
+// CropOptions specifies a lossless crop.
+type CropOptions struct {
+	CopyMarkers MarkerCopy // CopyMarkers specifies which extra markers are kept (CopyComments by default).
+}
+
+// Crop reads a JPEG image from r, crops it to rect without decoding its pixels
+// and writes the result into w, so that no quality is lost.
+//
+// The DCT blocks can only be cut at iMCU boundaries, so the top left corner
+// of rect is moved up and left to the nearest boundary (multiples of 8 or 16
+// pixels depending on the subsampling), while its bottom right corner is kept
+// within the image. The area actually kept is returned.
+func Crop(r io.Reader, w io.Writer, rect image.Rectangle, options *CropOptions) (image.Rectangle, error) {
+	if options == nil {
+		options = &CropOptions{}
+	}
+	d := new(Decoder)
+	defer d.Close()
+	c, err := d.readCoefficients(r, nil, options.CopyMarkers)
+	if err != nil {
+		return image.Rectangle{}, err
+	}
+	c, rect, err = cropCoefficients(c, rect)
+	if err != nil {
+		return image.Rectangle{}, err
+	}
+	e := new(Encoder)
+	defer e.Close()
+	err = e.writeCoefficients(w, c, &CoefficientOptions{ProgressiveMode: c.Progressive, OptimizeCoding: true})
+	if err != nil {
+		return image.Rectangle{}, err
+	}
+	return rect, nil
+}
+
+// cropArea returns rect clipped to the image with its origin aligned to the
+// iMCU grid of c.
+func cropArea(c *Coefficients, rect image.Rectangle) (image.Rectangle, error) {
+	rect = rect.Intersect(image.Rect(0, 0, c.Width, c.Height))
+	if rect.Empty() {
+		return image.Rectangle{}, errors.New("crop area is outside of the image")
+	}
+	iMCUWidth, iMCUHeight := c.iMCUSize()
+	rect.Min.X -= rect.Min.X % iMCUWidth
+	rect.Min.Y -= rect.Min.Y % iMCUHeight
+	return rect, nil
+}
+
+// cropCoefficients returns the blocks of c covering rect, and the area they
+// cover.
+func cropCoefficients(src *Coefficients, rect image.Rectangle) (*Coefficients, image.Rectangle, error) {
+	rect, err := cropArea(src, rect)
+	if err != nil {
+		return nil, image.Rectangle{}, err
+	}
+	iMCUWidth, iMCUHeight := src.iMCUSize()
+	dst := *src
+	dst.Width, dst.Height = rect.Dx(), rect.Dy()
+	dst.Components = make([]Component, len(src.Components))
+	copy(dst.Components, src.Components)
+	dst.Allocate()
+	for i := range dst.Components {
+		d, s := &dst.Components[i], &src.Components[i]
+		offsetX := rect.Min.X / iMCUWidth * s.HSampFactor
+		offsetY := rect.Min.Y / iMCUHeight * s.VSampFactor
+		for y := 0; y < d.HeightInBlocks && offsetY+y < s.HeightInBlocks; y++ {
+			row := s.Blocks[(offsetY+y)*s.WidthInBlocks+offsetX : (offsetY+y+1)*s.WidthInBlocks]
+			copy(d.Blocks[y*d.WidthInBlocks:(y+1)*d.WidthInBlocks], row)
+		}
+	}
+	return &dst, rect, nil
+}
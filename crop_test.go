@@ -0,0 +1,70 @@
+package jpeg
+
+import (
+	"bytes"
+	"image"
+	"io/ioutil"
+	"testing"
+)
+
+func TestCrop(t *testing.T) {
+	files := []string{
+		"images/kinkaku.jpg",
+		"images/testdata/video-001.q50.420.jpeg",
+		"images/testdata/video-001.q50.420.progressive.jpeg",
+		"images/testdata/video-001.q50.422.jpeg",
+		"images/testdata/video-001.q50.444.progressive.jpeg",
+		"images/testdata/video-005.gray.q50.jpeg",
+	}
+	rects := []image.Rectangle{
+		image.Rect(0, 0, 64, 48),
+		image.Rect(21, 37, 101, 90),
+		image.Rect(40, 40, 1000, 1000),
+		image.Rect(-10, -10, 5, 5),
+	}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatalf("reading file: %v", err)
+		}
+		src, err := DecodeBytesIntoRGB(data, nil)
+		if err != nil {
+			t.Fatalf("%s: DecodeIntoRGB returns error: %v", file, err)
+		}
+
+		for _, rect := range rects {
+			var out bytes.Buffer
+			got, err := Crop(bytes.NewReader(data), &out, rect, nil)
+			if err != nil {
+				t.Fatalf("%s: Crop %v returns error: %v", file, rect, err)
+			}
+			want := rect.Intersect(src.Bounds())
+			dx, dy := want.Min.X-got.Min.X, want.Min.Y-got.Min.Y
+			if got.Max != want.Max || dx < 0 || dy < 0 || dx >= 16 || dy >= 16 {
+				t.Errorf("%s: Crop %v: got %v", file, rect, got)
+			}
+
+			img, err := DecodeBytesIntoRGB(out.Bytes(), nil)
+			if err != nil {
+				t.Fatalf("%s: decoding crop %v returns error: %v", file, rect, err)
+			}
+			if b := img.Bounds(); b.Dx() != got.Dx() || b.Dy() != got.Dy() {
+				t.Errorf("%s: Crop %v: decoded %v, want the size of %v", file, rect, b, got)
+			}
+			d := transformDiff(img, img.Bounds(), src, func(x, y, w, h int) (int, int) {
+				return got.Min.X + x, got.Min.Y + y
+			})
+			if d > 2*0x101 {
+				t.Errorf("%s: Crop %v differs from the original by %v", file, rect, d)
+			}
+		}
+	}
+
+	data, err := ioutil.ReadFile("images/kinkaku.jpg")
+	if err != nil {
+		t.Fatalf("reading file: %v", err)
+	}
+	if _, err := Crop(bytes.NewReader(data), ioutil.Discard, image.Rect(2000, 2000, 2100, 2100), nil); err == nil {
+		t.Errorf("Crop outside of the image returns no error")
+	}
+}
@@ -98,6 +98,14 @@ static int DCT_v_scaled_size(j_decompress_ptr dinfo, int component) {
 #endif
 }
 
+static int DCT_h_scaled_size(j_decompress_ptr dinfo, int component) {
+#if JPEG_LIB_VERSION >= 70
+	return dinfo->comp_info[component].DCT_h_scaled_size;
+#else
+	return dinfo->comp_info[component].DCT_scaled_size;
+#endif
+}
+
 static JDIMENSION read_mcu_gray(struct jpeg_decompress_struct *dinfo, JSAMPROW pix, int stride, int imcu_rows, int *msg_code) {
 	// handle error
 	struct my_error_mgr *err = (struct my_error_mgr *)dinfo->err;
@@ -117,7 +125,7 @@ static JDIMENSION read_mcu_gray(struct jpeg_decompress_struct *dinfo, JSAMPROW p
 	return jpeg_read_raw_data(dinfo, &rows, imcu_rows);
 }
 
-static JDIMENSION read_mcu_ycbcr(struct jpeg_decompress_struct *dinfo, JSAMPROW y_row, JSAMPROW cb_row, JSAMPROW cr_row, int y_stride, int c_stride, int imcu_rows, int *msg_code) {
+static JDIMENSION read_mcu_ycbcr(struct jpeg_decompress_struct *dinfo, JSAMPROW y_row, JSAMPROW cb_row, JSAMPROW cr_row, int y_stride, int cb_stride, int cr_stride, int imcu_rows, int *msg_code) {
 	// handle error
 	struct my_error_mgr *err = (struct my_error_mgr *)dinfo->err;
 	if (setjmp(err->jmpbuf) != 0) {
@@ -138,8 +146,8 @@ static JDIMENSION read_mcu_ycbcr(struct jpeg_decompress_struct *dinfo, JSAMPROW
 	int h = 0;
 	for (h = 0; h < imcu_rows; h++) {
 		y_rows[h] = &y_row[y_stride * h];
-		cb_rows[h] = &cb_row[c_stride * h];
-		cr_rows[h] = &cr_row[c_stride * h];
+		cb_rows[h] = &cb_row[cb_stride * h];
+		cr_rows[h] = &cr_row[cr_stride * h];
 	}
 
 	// Get the data
@@ -151,32 +159,123 @@ static JDIMENSION read_mcu_ycbcr(struct jpeg_decompress_struct *dinfo, JSAMPROW
 import "C"
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"image"
 	"image/color"
 	"io"
+	"runtime"
 	"unsafe"
 )
 
-func newDecompress(r io.Reader) *C.struct_jpeg_decompress_struct {
-	dinfo := C.new_decompress()
-	if dinfo == nil {
+// Decoder decodes JPEG images while keeping its libjpeg decompressor and
+// source buffers alive between calls, which saves the setup cost when many
+// images are decoded in a row.
+//
+// A Decoder may be reused sequentially but must not be used by multiple
+// goroutines at the same time.
+type Decoder struct {
+	dinfo    *C.struct_jpeg_decompress_struct
+	src      *sourceManager
+	progress *C.struct_go_progress_mgr
+
+	// maxMemory is the max_memory_to_use set up by libjpeg, restored when
+	// DecoderOptions.MaxMemory is not set.
+	maxMemory C.long
+}
+
+// NewDecoder returns a new Decoder. The libjpeg resources are allocated on
+// first use and released by Close.
+func NewDecoder() *Decoder {
+	d := new(Decoder)
+	runtime.SetFinalizer(d, (*Decoder).Close)
+	return d
+}
+
+// Close releases the resources held by d. d must not be used after Close.
+func (d *Decoder) Close() {
+	runtime.SetFinalizer(d, nil)
+	if d.dinfo == nil {
+		return
+	}
+	releaseSourceManager(d.src)
+	C.destroy_decompress(d.dinfo)
+	releaseProgress(d.progress)
+	d.dinfo, d.src, d.progress = nil, nil, nil
+}
+
+// begin prepares the decompressor to read a new image from r with options.
+// Reading stops early once ctx is done.
+func (d *Decoder) begin(ctx context.Context, r io.Reader, options *DecoderOptions) error {
+	if d.dinfo == nil {
+		dinfo := C.new_decompress()
+		if dinfo == nil {
+			return errors.New("allocation failed")
+		}
+		src, err := makeSourceManager(dinfo)
+		if err != nil {
+			C.destroy_decompress(dinfo)
+			return err
+		}
+		d.dinfo, d.src = dinfo, src
+		d.maxMemory = dinfo.mem.max_memory_to_use
+	}
+	if options.MaxMemory > 0 {
+		d.dinfo.mem.max_memory_to_use = C.long(options.MaxMemory)
+	} else {
+		d.dinfo.mem.max_memory_to_use = d.maxMemory
+	}
+	if err := attachSourceManager(d.src, r, bufferSize(options.ReadBufferSize)); err != nil {
+		return err
+	}
+	d.src.ctx = ctx
+	if err := attachProgress(unsafe.Pointer(d.dinfo), &d.progress, options.Progress, options.MaxScans); err != nil {
+		detachSourceManager(d.src)
+		return err
+	}
+	return nil
+}
+
+// end resets the decompressor so that it can be used for the next image.
+func (d *Decoder) end() {
+	C.jpeg_abort_decompress(d.dinfo)
+	detachSourceManager(d.src)
+	detachProgress(unsafe.Pointer(d.dinfo), d.progress)
+}
+
+// limitError replaces err with a *LimitError if libjpeg failed because of
+// options.MaxScans or options.MaxMemory.
+func (d *Decoder) limitError(err error, options *DecoderOptions) error {
+	if err == nil {
 		return nil
 	}
-	makeSourceManager(r, dinfo)
-	return dinfo
+	if options.MaxScans > 0 && d.progress.scan_limit_hit != 0 {
+		return &LimitError{Limit: "MaxScans", Value: int64(d.dinfo.input_scan_number), Max: int64(options.MaxScans)}
+	}
+	if options.MaxMemory > 0 {
+		switch d.dinfo.err.msg_code {
+		case C.JERR_OUT_OF_MEMORY, C.JERR_NO_BACKING_STORE:
+			return &LimitError{Limit: "MaxMemory", Max: options.MaxMemory}
+		}
+	}
+	return err
 }
 
-func destroyDecompress(dinfo *C.struct_jpeg_decompress_struct) {
-	if dinfo == nil {
-		return
+// checkLimits checks the image dimensions read from the header against the
+// limits of options.
+func checkLimits(dinfo *C.struct_jpeg_decompress_struct, options *DecoderOptions) error {
+	width, height := int64(dinfo.image_width), int64(dinfo.image_height)
+	if options.MaxWidth > 0 && width > int64(options.MaxWidth) {
+		return &LimitError{Limit: "MaxWidth", Value: width, Max: int64(options.MaxWidth)}
+	}
+	if options.MaxHeight > 0 && height > int64(options.MaxHeight) {
+		return &LimitError{Limit: "MaxHeight", Value: height, Max: int64(options.MaxHeight)}
 	}
-	sourceManager := getSourceManager(dinfo)
-	if sourceManager != nil {
-		releaseSourceManager(sourceManager)
+	if options.MaxPixels > 0 && width*height > options.MaxPixels {
+		return &LimitError{Limit: "MaxPixels", Value: width * height, Max: options.MaxPixels}
 	}
-	C.destroy_decompress(dinfo)
+	return nil
 }
 
 func readHeader(dinfo *C.struct_jpeg_decompress_struct) error {
@@ -220,9 +319,9 @@ func readMCUGray(dinfo *C.struct_jpeg_decompress_struct, pix C.JSAMPROW, stride,
 	return
 }
 
-func readMCUYCbCr(dinfo *C.struct_jpeg_decompress_struct, y, cb, cr C.JSAMPROW, yStride, cStride int, iMCURows int) (line C.JDIMENSION, err error) {
+func readMCUYCbCr(dinfo *C.struct_jpeg_decompress_struct, y, cb, cr C.JSAMPROW, yStride, cbStride, crStride int, iMCURows int) (line C.JDIMENSION, err error) {
 	code := C.int(0)
-	line = C.read_mcu_ycbcr(dinfo, y, cb, cr, C.int(yStride), C.int(cStride), C.int(iMCURows), &code)
+	line = C.read_mcu_ycbcr(dinfo, y, cb, cr, C.int(yStride), C.int(cbStride), C.int(crStride), C.int(iMCURows), &code)
 	if code != 0 {
 		err = errors.New(jpegErrorMessage(unsafe.Pointer(dinfo)))
 	}
@@ -232,9 +331,47 @@ func readMCUYCbCr(dinfo *C.struct_jpeg_decompress_struct, y, cb, cr C.JSAMPROW,
 // DecoderOptions specifies JPEG decoding parameters.
 type DecoderOptions struct {
 	ScaleTarget            image.Rectangle // ScaleTarget is the target size to scale image.
+	ScaleMode              ScaleMode       // ScaleMode is how the scale is chosen from ScaleTarget.
+	AllowUpscale           bool            // If true, ScaleTarget may scale the image up to twice its size.
+	Scale                  Scale           // Scale is an explicit scaling factor used instead of ScaleTarget if set.
 	DCTMethod              DCTMethod       // DCTMethod is DCT Algorithm method.
 	DisableFancyUpsampling bool            // If true, disable fancy upsampling
 	DisableBlockSmoothing  bool            // If true, disable block smoothing
+	ReadBufferSize         int             // ReadBufferSize is the size of the read buffer (DefaultBufferSize if 0).
+	Progress               ProgressFunc    // Progress is called with progress reports if not nil.
+
+	// Limits for decoding untrusted images. Each limit is disabled if 0, and
+	// exceeding one makes decoding fail with an error matching
+	// ErrLimitExceeded. The dimensions are checked against the header before
+	// any pixel buffer is allocated.
+	MaxWidth  int   // MaxWidth is the maximum image width.
+	MaxHeight int   // MaxHeight is the maximum image height.
+	MaxPixels int64 // MaxPixels is the maximum number of pixels, width times height.
+	MaxMemory int64 // MaxMemory is the maximum number of bytes libjpeg may allocate for its work buffers (max_memory_to_use).
+	MaxScans  int   // MaxScans is the maximum number of scans read from a progressive image.
+}
+
+// ErrLimitExceeded is matched by the errors returned when an image exceeds a
+// limit set in DecoderOptions.
+var ErrLimitExceeded = errors.New("limit exceeded")
+
+// LimitError reports which limit of DecoderOptions an image exceeded.
+type LimitError struct {
+	Limit string // Limit is the name of the DecoderOptions field.
+	Value int64  // Value is the offending value, or 0 if it is not known.
+	Max   int64  // Max is the configured limit.
+}
+
+func (e *LimitError) Error() string {
+	if e.Value == 0 {
+		return fmt.Sprintf("%s: %s (%d)", ErrLimitExceeded, e.Limit, e.Max)
+	}
+	return fmt.Sprintf("%s: %s %d > %d", ErrLimitExceeded, e.Limit, e.Value, e.Max)
+}
+
+// Is makes errors.Is(err, ErrLimitExceeded) report true for a *LimitError.
+func (e *LimitError) Is(target error) bool {
+	return target == ErrLimitExceeded
 }
 
 // SupportRGBA returns whether RGBA decoding is supported.
@@ -244,36 +381,91 @@ func SupportRGBA() bool {
 
 // Decode reads a JPEG data stream from r and returns decoded image as an image.Image.
 // Output image has YCbCr colors or 8bit Grayscale.
+//
+// If r is a *bytes.Buffer, its contents are decoded in place without copying;
+// DecodeBytes does the same for a byte slice.
 func Decode(r io.Reader, options *DecoderOptions) (dest image.Image, err error) {
-	dinfo := newDecompress(r)
-	if dinfo == nil {
-		return nil, errors.New("allocation failed")
-	}
-	defer destroyDecompress(dinfo)
+	d := new(Decoder)
+	defer d.Close()
+	return d.Decode(r, options)
+}
+
+// DecodeContext is like Decode but gives up decoding once ctx is done.
+// The returned error then wraps ctx.Err().
+func DecodeContext(ctx context.Context, r io.Reader, options *DecoderOptions) (dest image.Image, err error) {
+	d := new(Decoder)
+	defer d.Close()
+	return d.DecodeContext(ctx, r, options)
+}
 
+// Decode reads a JPEG data stream from r and returns decoded image as an image.Image.
+// Output image has YCbCr colors or 8bit Grayscale.
+func (d *Decoder) Decode(r io.Reader, options *DecoderOptions) (dest image.Image, err error) {
+	return d.DecodeContext(context.Background(), r, options)
+}
+
+// DecodeContext is like Decode but gives up decoding once ctx is done.
+// The returned error then wraps ctx.Err().
+func (d *Decoder) DecodeContext(ctx context.Context, r io.Reader, options *DecoderOptions) (dest image.Image, err error) {
+	return d.decode(ctx, r, options, nil)
+}
+
+// decode implements DecodeContext. If chooseScale is not nil, it overrides the
+// scale of options once the image size has been read from the header.
+func (d *Decoder) decode(ctx context.Context, r io.Reader, options *DecoderOptions, chooseScale func(width, height int) Scale) (dest image.Image, err error) {
+	if err = canceled(ctx, "decoding"); err != nil {
+		return nil, err
+	}
+	defer func() {
+		// Errors caused by the input being cut short are reported as the
+		// cancellation.
+		if err != nil {
+			if cerr := canceled(ctx, "decoding"); cerr != nil {
+				dest, err = nil, cerr
+			}
+		}
+	}()
 	if options == nil {
 		options = &DecoderOptions{}
 	}
 
+	err = d.begin(ctx, r, options)
+	if err != nil {
+		return nil, err
+	}
+	defer d.end()
+	defer func() { err = d.limitError(err, options) }()
+	dinfo := d.dinfo
+
 	err = readHeader(dinfo)
 	if err != nil {
 		return nil, err
 	}
+	err = checkLimits(dinfo, options)
+	if err != nil {
+		return nil, err
+	}
 
-	setupDecoderOptions(dinfo, options)
+	if chooseScale != nil {
+		scaled := *options
+		scaled.Scale = chooseScale(int(dinfo.image_width), int(dinfo.image_height))
+		setupDecoderOptions(dinfo, &scaled)
+	} else {
+		setupDecoderOptions(dinfo, options)
+	}
 
 	switch dinfo.num_components {
 	case 1:
 		if dinfo.jpeg_color_space != C.JCS_GRAYSCALE {
 			return nil, errors.New("unsupported colorspace")
 		}
-		dest, err = decodeGray(dinfo)
+		dest, err = decodeGray(ctx, dinfo)
 	case 3:
 		switch dinfo.jpeg_color_space {
 		case C.JCS_YCbCr:
-			dest, err = decodeYCbCr(dinfo)
+			dest, err = decodeYCbCr(ctx, dinfo)
 		case C.JCS_RGB:
-			dest, err = decodeRGB(dinfo)
+			dest, err = decodeRGB(ctx, dinfo)
 		default:
 			return nil, errors.New("unsupported colorspace")
 		}
@@ -283,11 +475,14 @@ func Decode(r io.Reader, options *DecoderOptions) (dest image.Image, err error)
 	return
 }
 
-func decodeGray(dinfo *C.struct_jpeg_decompress_struct) (dest *image.Gray, err error) {
+func decodeGray(ctx context.Context, dinfo *C.struct_jpeg_decompress_struct) (dest *image.Gray, err error) {
 	// output dawnsampled raw data before starting decompress
 	dinfo.raw_data_out = C.TRUE
 
 	err = startDecompress(dinfo)
+	if err == nil {
+		err = canceled(ctx, "decoding")
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -302,21 +497,31 @@ func decodeGray(dinfo *C.struct_jpeg_decompress_struct) (dest *image.Gray, err e
 	dest = NewGrayAligned(image.Rect(0, 0, int(compInfo[0].downsampled_width), int(compInfo[0].downsampled_height)))
 
 	iMCURows := int(C.DCT_v_scaled_size(dinfo, C.int(0)) * compInfo[0].v_samp_factor)
+	plane := rawPlane{pix: dest.Pix, stride: dest.Stride, width: dest.Rect.Dx(), height: dest.Rect.Dy(), paddedWidth: paddedWidth(dinfo, 0)}
 
 	for dinfo.output_scanline < dinfo.output_height {
-		_, err = readMCUGray(dinfo, C.JSAMPROW(unsafe.Pointer(&dest.Pix[dest.Stride*int(dinfo.output_scanline)])), dest.Stride, iMCURows)
+		if err = canceled(ctx, "decoding"); err != nil {
+			return
+		}
+		v := int(dinfo.output_scanline)
+		pix, stride := plane.output(v, iMCURows)
+		_, err = readMCUGray(dinfo, C.JSAMPROW(unsafe.Pointer(&pix[0])), stride, iMCURows)
 		if err != nil {
 			return
 		}
+		plane.flush(v, iMCURows)
 	}
 	return
 }
 
-func decodeYCbCr(dinfo *C.struct_jpeg_decompress_struct) (dest *image.YCbCr, err error) {
+func decodeYCbCr(ctx context.Context, dinfo *C.struct_jpeg_decompress_struct) (dest *image.YCbCr, err error) {
 	// output dawnsampled raw data before starting decompress
 	dinfo.raw_data_out = C.TRUE
 
 	err = startDecompress(dinfo)
+	if err == nil {
+		err = canceled(ctx, "decoding")
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -362,22 +567,49 @@ func decodeYCbCr(dinfo *C.struct_jpeg_decompress_struct) (dest *image.YCbCr, err
 			iMCURows = compRows
 		}
 	}
-	yStride, cStride := dest.YStride, dest.CStride
+	yRows := int(C.DCT_v_scaled_size(dinfo, C.int(Y)) * compInfo[Y].v_samp_factor)
+	cRows := int(C.DCT_v_scaled_size(dinfo, C.int(Cb)) * compInfo[Cb].v_samp_factor)
+	yPlane := rawPlane{pix: dest.Y, stride: dest.YStride, width: int(dwY), height: int(dhY), paddedWidth: paddedWidth(dinfo, Y)}
+	cbPlane := rawPlane{pix: dest.Cb, stride: dest.CStride, width: int(dwC), height: int(dhC), paddedWidth: paddedWidth(dinfo, Cb)}
+	crPlane := rawPlane{pix: dest.Cr, stride: dest.CStride, width: int(dwC), height: int(dhC), paddedWidth: paddedWidth(dinfo, Cr)}
 
 	for dinfo.output_scanline < dinfo.output_height {
-		y := C.JSAMPROW(unsafe.Pointer(&dest.Y[yStride*int(dinfo.output_scanline)]))
-		cb := C.JSAMPROW(unsafe.Pointer(&dest.Cb[cStride*int(dinfo.output_scanline)/cVDiv]))
-		cr := C.JSAMPROW(unsafe.Pointer(&dest.Cr[cStride*int(dinfo.output_scanline)/cVDiv]))
-		_, err = readMCUYCbCr(dinfo, y, cb, cr, yStride, cStride, iMCURows)
+		if err = canceled(ctx, "decoding"); err != nil {
+			return
+		}
+		v := int(dinfo.output_scanline)
+		y, yStride := yPlane.output(v, yRows)
+		cb, cbStride := cbPlane.output(v/cVDiv, cRows)
+		cr, crStride := crPlane.output(v/cVDiv, cRows)
+		_, err = readMCUYCbCr(
+			dinfo,
+			C.JSAMPROW(unsafe.Pointer(&y[0])),
+			C.JSAMPROW(unsafe.Pointer(&cb[0])),
+			C.JSAMPROW(unsafe.Pointer(&cr[0])),
+			yStride, cbStride, crStride, iMCURows,
+		)
 		if err != nil {
 			return
 		}
+		yPlane.flush(v, yRows)
+		cbPlane.flush(v/cVDiv, cRows)
+		crPlane.flush(v/cVDiv, cRows)
 	}
 	return
 }
 
-func readRGBScanlines(dinfo *C.struct_jpeg_decompress_struct, pix []uint8, stride int) (err error) {
+// paddedWidth returns the number of columns libjpeg writes into the rows of
+// component i in raw data mode.
+func paddedWidth(dinfo *C.struct_jpeg_decompress_struct, i int) int {
+	compInfo := (*[C.MAX_COMPONENTS]C.jpeg_component_info)(unsafe.Pointer(dinfo.comp_info))
+	return int(compInfo[i].width_in_blocks) * int(C.DCT_h_scaled_size(dinfo, C.int(i)))
+}
+
+func readRGBScanlines(ctx context.Context, dinfo *C.struct_jpeg_decompress_struct, pix []uint8, stride int) (err error) {
 	err = startDecompress(dinfo)
+	if err == nil {
+		err = canceled(ctx, "decoding")
+	}
 	if err != nil {
 		return
 	}
@@ -389,6 +621,9 @@ func readRGBScanlines(dinfo *C.struct_jpeg_decompress_struct, pix []uint8, strid
 	}()
 
 	for dinfo.output_scanline < dinfo.output_height {
+		if err = canceled(ctx, "decoding"); err != nil {
+			return
+		}
 		pbuf := (*C.uchar)(unsafe.Pointer(&pix[stride*int(dinfo.output_scanline)]))
 		_, err = readScanlines(dinfo, pbuf, C.int(stride), dinfo.rec_outbuf_height)
 		if err != nil {
@@ -399,40 +634,71 @@ func readRGBScanlines(dinfo *C.struct_jpeg_decompress_struct, pix []uint8, strid
 }
 
 // TODO: supports decoding into image.RGBA instead of Image.
-func decodeRGB(dinfo *C.struct_jpeg_decompress_struct) (dest *RGB, err error) {
+func decodeRGB(ctx context.Context, dinfo *C.struct_jpeg_decompress_struct) (dest *RGB, err error) {
 	C.jpeg_calc_output_dimensions(dinfo)
 	dest = NewRGB(image.Rect(0, 0, int(dinfo.output_width), int(dinfo.output_height)))
 
 	dinfo.out_color_space = C.JCS_RGB
-	err = readRGBScanlines(dinfo, dest.Pix, dest.Stride)
+	err = readRGBScanlines(ctx, dinfo, dest.Pix, dest.Stride)
 	return
 }
 
 // DecodeIntoRGB reads a JPEG data stream from r and returns decoded image as an Image with RGB colors.
 func DecodeIntoRGB(r io.Reader, options *DecoderOptions) (dest *RGB, err error) {
-	dinfo := newDecompress(r)
-	if dinfo == nil {
-		return nil, errors.New("allocation failed")
+	d := new(Decoder)
+	defer d.Close()
+	return d.DecodeIntoRGB(r, options)
+}
+
+// DecodeIntoRGB reads a JPEG data stream from r and returns decoded image as an Image with RGB colors.
+func (d *Decoder) DecodeIntoRGB(r io.Reader, options *DecoderOptions) (dest *RGB, err error) {
+	if options == nil {
+		options = &DecoderOptions{}
 	}
-	defer destroyDecompress(dinfo)
+
+	err = d.begin(context.Background(), r, options)
+	if err != nil {
+		return nil, err
+	}
+	defer d.end()
+	defer func() { err = d.limitError(err, options) }()
+	dinfo := d.dinfo
 
 	err = readHeader(dinfo)
 	if err != nil {
 		return nil, err
 	}
+	err = checkLimits(dinfo, options)
+	if err != nil {
+		return nil, err
+	}
 
 	setupDecoderOptions(dinfo, options)
-	return decodeRGB(dinfo)
+	return decodeRGB(context.Background(), dinfo)
 }
 
 // DecodeIntoRGBA reads a JPEG data stream from r and returns decoded image as an image.RGBA with RGBA colors.
 // This function only works with libjpeg-turbo, not libjpeg.
 func DecodeIntoRGBA(r io.Reader, options *DecoderOptions) (dest *image.RGBA, err error) {
-	dinfo := newDecompress(r)
-	if dinfo == nil {
-		return nil, errors.New("allocation failed")
+	d := new(Decoder)
+	defer d.Close()
+	return d.DecodeIntoRGBA(r, options)
+}
+
+// DecodeIntoRGBA reads a JPEG data stream from r and returns decoded image as an image.RGBA with RGBA colors.
+// This function only works with libjpeg-turbo, not libjpeg.
+func (d *Decoder) DecodeIntoRGBA(r io.Reader, options *DecoderOptions) (dest *image.RGBA, err error) {
+	if options == nil {
+		options = &DecoderOptions{}
+	}
+
+	err = d.begin(context.Background(), r, options)
+	if err != nil {
+		return nil, err
 	}
-	defer destroyDecompress(dinfo)
+	defer d.end()
+	defer func() { err = d.limitError(err, options) }()
+	dinfo := d.dinfo
 
 	// Recover panic
 	defer func() {
@@ -447,6 +713,10 @@ func DecodeIntoRGBA(r io.Reader, options *DecoderOptions) (dest *image.RGBA, err
 	if err != nil {
 		return nil, err
 	}
+	err = checkLimits(dinfo, options)
+	if err != nil {
+		return nil, err
+	}
 
 	setupDecoderOptions(dinfo, options)
 
@@ -458,19 +728,26 @@ func DecodeIntoRGBA(r io.Reader, options *DecoderOptions) (dest *image.RGBA, err
 		return nil, errors.New("JCS_EXT_RGBA is not supported (probably built without libjpeg-turbo)")
 	}
 	dinfo.out_color_space = colorSpace
-	err = readRGBScanlines(dinfo, dest.Pix, dest.Stride)
+	err = readRGBScanlines(context.Background(), dinfo, dest.Pix, dest.Stride)
 
 	return
 }
 
 // DecodeConfig returns the color model and dimensions of a JPEG image without decoding the entire image.
 func DecodeConfig(r io.Reader) (config image.Config, err error) {
-	dinfo := newDecompress(r)
-	if dinfo == nil {
-		err = errors.New("allocation failed")
+	d := new(Decoder)
+	defer d.Close()
+	return d.DecodeConfig(r)
+}
+
+// DecodeConfig returns the color model and dimensions of a JPEG image without decoding the entire image.
+func (d *Decoder) DecodeConfig(r io.Reader) (config image.Config, err error) {
+	err = d.begin(context.Background(), r, &DecoderOptions{})
+	if err != nil {
 		return
 	}
-	defer destroyDecompress(dinfo)
+	defer d.end()
+	dinfo := d.dinfo
 
 	// Recover panic
 	defer func() {
@@ -494,21 +771,126 @@ func DecodeConfig(r io.Reader) (config image.Config, err error) {
 	return
 }
 
-func setupDecoderOptions(dinfo *C.struct_jpeg_decompress_struct, opt *DecoderOptions) {
+// DecodeBytes decodes a JPEG image held in data. data is handed to libjpeg
+// directly instead of being copied through the read buffer.
+// Output image has YCbCr colors or 8bit Grayscale.
+func DecodeBytes(data []byte, options *DecoderOptions) (dest image.Image, err error) {
+	return Decode(newBytesReader(data), options)
+}
+
+// DecodeBytesIntoRGB decodes a JPEG image held in data into an Image with RGB colors.
+func DecodeBytesIntoRGB(data []byte, options *DecoderOptions) (dest *RGB, err error) {
+	return DecodeIntoRGB(newBytesReader(data), options)
+}
+
+// DecodeBytesIntoRGBA decodes a JPEG image held in data into an image.RGBA with RGBA colors.
+// This function only works with libjpeg-turbo, not libjpeg.
+func DecodeBytesIntoRGBA(data []byte, options *DecoderOptions) (dest *image.RGBA, err error) {
+	return DecodeIntoRGBA(newBytesReader(data), options)
+}
+
+// DecodeBytesConfig returns the color model and dimensions of a JPEG image held in data.
+func DecodeBytesConfig(data []byte) (config image.Config, err error) {
+	return DecodeConfig(newBytesReader(data))
+}
+
+// Scale is a scaling factor Num/Denom applied by the IDCT while decoding.
+//
+// libjpeg-turbo scales by N/8 for N = 1..16, so the factor is rounded up to
+// the next such fraction and clamped to the range 1/8..2.
+type Scale struct {
+	Num, Denom int
+}
+
+// ScaleMode specifies how the scaling factor is chosen from ScaleTarget.
+type ScaleMode int
+
+const (
+	// ScaleCover picks the smallest scale at which the image covers
+	// ScaleTarget, i.e. both dimensions are at least as large.
+	ScaleCover ScaleMode = iota
+	// ScaleFit picks the largest scale at which the image fits inside
+	// ScaleTarget, or 1/8 if even that is too large.
+	ScaleFit
+	// ScaleNearest picks the scale at which the image size is closest to
+	// ScaleTarget.
+	ScaleNearest
+)
+
+// scaleFactor returns the numerator N of the N/8 scale chosen by opt for an
+// image of width x height.
+func scaleFactor(width, height int, opt *DecoderOptions) int {
+	if opt.Scale.Num > 0 && opt.Scale.Denom > 0 {
+		n := (opt.Scale.Num*8 + opt.Scale.Denom - 1) / opt.Scale.Denom
+		if n < 1 {
+			return 1
+		}
+		if n > 16 {
+			return 16
+		}
+		return n
+	}
+
 	tw, th := opt.ScaleTarget.Dx(), opt.ScaleTarget.Dy()
-	if tw > 0 && th > 0 {
-		var scaleFactor int
-		for scaleFactor = 1; scaleFactor <= 8; scaleFactor++ {
-			if ((scaleFactor*int(dinfo.image_width)+7)/8) >= tw &&
-				((scaleFactor*int(dinfo.image_height)+7)/8) >= th {
+	if tw <= 0 || th <= 0 {
+		return 8
+	}
+	maxFactor := 8
+	if opt.AllowUpscale {
+		maxFactor = 16
+	}
+	scaled := func(n, size int) int {
+		return (n*size + 7) / 8
+	}
+	switch opt.ScaleMode {
+	case ScaleFit:
+		n := 1
+		for f := 2; f <= maxFactor; f++ {
+			if scaled(f, width) > tw || scaled(f, height) > th {
 				break
 			}
+			n = f
 		}
-		if scaleFactor < 8 {
-			dinfo.scale_num = C.uint(scaleFactor)
-			dinfo.scale_denom = 8
+		return n
+	case ScaleNearest:
+		n, best := 1, -1
+		for f := 1; f <= maxFactor; f++ {
+			d := abs(scaled(f, width)-tw) + abs(scaled(f, height)-th)
+			if best < 0 || d < best {
+				n, best = f, d
+			}
 		}
+		return n
+	default:
+		for f := 1; f < maxFactor; f++ {
+			if scaled(f, width) >= tw && scaled(f, height) >= th {
+				return f
+			}
+		}
+		return maxFactor
+	}
+}
+
+func abs(a int) int {
+	if a < 0 {
+		return -a
 	}
+	return a
+}
+
+// ScaledSize returns the dimensions of the image described by config after
+// decoding it with options, without decoding anything.
+func ScaledSize(config image.Config, options *DecoderOptions) (width, height int) {
+	if options == nil {
+		return config.Width, config.Height
+	}
+	n := scaleFactor(config.Width, config.Height, options)
+	return (n*config.Width + 7) / 8, (n*config.Height + 7) / 8
+}
+
+func setupDecoderOptions(dinfo *C.struct_jpeg_decompress_struct, opt *DecoderOptions) {
+	dinfo.scale_num = C.uint(scaleFactor(int(dinfo.image_width), int(dinfo.image_height), opt))
+	dinfo.scale_denom = 8
 
 	dinfo.dct_method = C.J_DCT_METHOD(opt.DCTMethod)
 	if opt.DisableFancyUpsampling {
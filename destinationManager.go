@@ -10,51 +10,70 @@ package jpeg
 /*
 #include <stdlib.h>
 #include <stdio.h>
+#include <stdint.h>
 #include <jpeglib.h>
 
+// go_destination_mgr extends jpeg_destination_mgr with a cgo.Handle of the Go
+// side destinationManager, so that the callbacks can find it without a global
+// lookup.
+struct go_destination_mgr {
+	struct jpeg_destination_mgr pub;
+	uintptr_t handle;
+};
+
 // exported from golang
 void destinationInit(struct jpeg_compress_struct*);
 boolean destinationEmpty(struct jpeg_compress_struct*);
 void destinationTerm(struct jpeg_compress_struct*);
 
-static struct jpeg_destination_mgr *calloc_jpeg_destination_mgr(void) {
-	return calloc(sizeof(struct jpeg_destination_mgr), 1);
+static struct go_destination_mgr *calloc_go_destination_mgr(void) {
+	return calloc(sizeof(struct go_destination_mgr), 1);
 }
 
-static void free_jpeg_destination_mgr(struct jpeg_destination_mgr *p) {
+static void free_go_destination_mgr(struct go_destination_mgr *p) {
 	free(p);
 }
 
+static uintptr_t destination_handle(struct jpeg_compress_struct *cinfo) {
+	return ((struct go_destination_mgr *)cinfo->dest)->handle;
+}
+
 */
 import "C"
 
 import (
 	"errors"
 	"io"
-	"sync"
+	"runtime/cgo"
+	"sync/atomic"
 	"unsafe"
 )
 
-const writeBufferSize = 16384
-
-var destinationManagerMapMutex sync.RWMutex
-var destinationManagerMap = make(map[uintptr]*destinationManager)
+var workingDestinationManagers int64
 
 // DestinationManagerMapLen returns the number of globally working destinationManagers for debug.
 func DestinationManagerMapLen() int {
-	return len(destinationManagerMap)
+	return int(atomic.LoadInt64(&workingDestinationManagers))
 }
 
 type destinationManager struct {
-	pub    *C.struct_jpeg_destination_mgr
-	buffer unsafe.Pointer
-	dest   io.Writer
+	ext        *C.struct_go_destination_mgr
+	pub        *C.struct_jpeg_destination_mgr
+	buffer     unsafe.Pointer
+	bufferSize int
+	dest       io.Writer
+
+	// Growable C buffer used instead of dest when encoding into memory.
+	// It is kept between images so that a reused Encoder does not need to
+	// grow it again.
+	inMemory bool
+	mem      unsafe.Pointer
+	memSize  int
+	memLen   int
 }
 
 func getDestinationManager(cinfo *C.struct_jpeg_compress_struct) (ret *destinationManager) {
-	destinationManagerMapMutex.RLock()
-	defer destinationManagerMapMutex.RUnlock()
-	return destinationManagerMap[uintptr(unsafe.Pointer(cinfo.dest))]
+	return cgo.Handle(C.destination_handle(cinfo)).Value().(*destinationManager)
 }
 
 //export destinationInit
@@ -72,16 +91,44 @@ func flushBuffer(mgr *destinationManager, inBuffer int) error {
 		}
 		wrote += bytes
 	}
-	mgr.pub.free_in_buffer = writeBufferSize
+	mgr.pub.free_in_buffer = C.size_t(mgr.bufferSize)
 	mgr.pub.next_output_byte = (*C.JOCTET)(mgr.buffer)
 	return nil
 }
 
+// growMemory doubles the in-memory buffer and points libjpeg at its free part.
+func growMemory(mgr *destinationManager) error {
+	size := mgr.memSize * 2
+	mem := C.realloc(mgr.mem, C.size_t(size))
+	if mem == nil {
+		return errors.New("failed to allocate buffer")
+	}
+	mgr.pub.next_output_byte = (*C.JOCTET)(unsafe.Add(mem, mgr.memSize))
+	mgr.pub.free_in_buffer = C.size_t(size - mgr.memSize)
+	mgr.mem, mgr.memSize = mem, size
+	return nil
+}
+
+// memoryBytes returns the data written by the last in-memory encoding. The
+// slice refers to C memory and is only valid until the next encoding.
+func memoryBytes(mgr *destinationManager) []byte {
+	if mgr.memLen == 0 {
+		return nil
+	}
+	return unsafe.Slice((*byte)(mgr.mem), mgr.memLen)
+}
+
 //export destinationEmpty
 func destinationEmpty(cinfo *C.struct_jpeg_compress_struct) C.boolean {
-	// need to write *entire* buffer, not subtracting free_in_buffer
 	mgr := getDestinationManager(cinfo)
-	err := flushBuffer(mgr, writeBufferSize)
+	if mgr.inMemory {
+		if growMemory(mgr) != nil {
+			return C.FALSE
+		}
+		return C.TRUE
+	}
+	// need to write *entire* buffer, not subtracting free_in_buffer
+	err := flushBuffer(mgr, mgr.bufferSize)
 	if err != nil {
 		return C.FALSE
 	}
@@ -90,47 +137,89 @@ func destinationEmpty(cinfo *C.struct_jpeg_compress_struct) C.boolean {
 
 //export destinationTerm
 func destinationTerm(cinfo *C.struct_jpeg_compress_struct) {
-	// just empty buffer
 	mgr := getDestinationManager(cinfo)
-	inBuffer := int(writeBufferSize - mgr.pub.free_in_buffer)
+	if mgr.inMemory {
+		mgr.memLen = mgr.memSize - int(mgr.pub.free_in_buffer)
+		return
+	}
+	// just empty buffer
+	inBuffer := mgr.bufferSize - int(mgr.pub.free_in_buffer)
 	flushBuffer(mgr, inBuffer) // can ignore error here
 }
 
-func makeDestinationManager(dest io.Writer, cinfo *C.struct_jpeg_compress_struct) (mgr *destinationManager, err error) {
+func makeDestinationManager(cinfo *C.struct_jpeg_compress_struct) (mgr *destinationManager, err error) {
 	mgr = new(destinationManager)
-	mgr.dest = dest
-	mgr.pub = C.calloc_jpeg_destination_mgr()
-	if mgr.pub == nil {
-		err = errors.New("failed to allocate C.struct_jpeg_destination_mgr")
+	mgr.ext = C.calloc_go_destination_mgr()
+	if mgr.ext == nil {
+		err = errors.New("failed to allocate C.struct_go_destination_mgr")
 		return
 	}
-	mgr.buffer = C.calloc(writeBufferSize, 1)
+	mgr.pub = &mgr.ext.pub
+	mgr.bufferSize = DefaultBufferSize
+	mgr.buffer = C.calloc(C.size_t(mgr.bufferSize), 1)
 	if mgr.buffer == nil {
-		C.free_jpeg_destination_mgr(mgr.pub)
+		C.free_go_destination_mgr(mgr.ext)
 		err = errors.New("failed to allocate buffer")
 		return
 	}
 	mgr.pub.init_destination = (*[0]byte)(C.destinationInit)
 	mgr.pub.empty_output_buffer = (*[0]byte)(C.destinationEmpty)
 	mgr.pub.term_destination = (*[0]byte)(C.destinationTerm)
-	mgr.pub.free_in_buffer = writeBufferSize
-	mgr.pub.next_output_byte = (*C.JOCTET)(mgr.buffer)
 	cinfo.dest = mgr.pub
+	return
+}
 
-	destinationManagerMapMutex.Lock()
-	defer destinationManagerMapMutex.Unlock()
-	destinationManagerMap[uintptr(unsafe.Pointer(mgr.pub))] = mgr
+// attachDestinationManager makes mgr write into dest and hands a cgo.Handle of
+// it to the C side so that the libjpeg callbacks can find it.
+//
+// The data is written through a buffer of size bytes. If dest is nil, the data
+// is collected in a growable C buffer of at least size bytes instead, which can
+// be read with memoryBytes after the compression has finished.
+func attachDestinationManager(mgr *destinationManager, dest io.Writer, size int) error {
+	mgr.dest = dest
+	mgr.inMemory = dest == nil
+	if mgr.inMemory {
+		if mgr.memSize < size {
+			mem := C.realloc(mgr.mem, C.size_t(size))
+			if mem == nil {
+				return errors.New("failed to allocate buffer")
+			}
+			mgr.mem, mgr.memSize = mem, size
+		}
+		mgr.memLen = 0
+		mgr.pub.free_in_buffer = C.size_t(mgr.memSize)
+		mgr.pub.next_output_byte = (*C.JOCTET)(mgr.mem)
+	} else {
+		if size != mgr.bufferSize {
+			buffer := C.realloc(mgr.buffer, C.size_t(size))
+			if buffer == nil {
+				return errors.New("failed to allocate buffer")
+			}
+			mgr.buffer, mgr.bufferSize = buffer, size
+		}
+		mgr.pub.free_in_buffer = C.size_t(mgr.bufferSize)
+		mgr.pub.next_output_byte = (*C.JOCTET)(mgr.buffer)
+	}
+	mgr.ext.handle = C.uintptr_t(cgo.NewHandle(mgr))
+	atomic.AddInt64(&workingDestinationManagers, 1)
+	return nil
+}
 
-	return
+// detachDestinationManager deletes the handle of mgr and drops its writer. The
+// C buffers are kept so that mgr can be attached again.
+func detachDestinationManager(mgr *destinationManager) {
+	if mgr.ext.handle == 0 {
+		return
+	}
+	cgo.Handle(mgr.ext.handle).Delete()
+	mgr.ext.handle = 0
+	mgr.dest = nil
+	atomic.AddInt64(&workingDestinationManagers, -1)
 }
 
 func releaseDestinationManager(mgr *destinationManager) {
-	destinationManagerMapMutex.Lock()
-	defer destinationManagerMapMutex.Unlock()
-	var key = uintptr(unsafe.Pointer(mgr.pub))
-	if _, ok := destinationManagerMap[key]; ok {
-		delete(destinationManagerMap, key)
-		C.free_jpeg_destination_mgr(mgr.pub)
-		C.free(mgr.buffer)
-	}
+	detachDestinationManager(mgr)
+	C.free_go_destination_mgr(mgr.ext)
+	C.free(mgr.buffer)
+	C.free(mgr.mem)
 }
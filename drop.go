@@ -0,0 +1,75 @@
+package jpeg
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"io"
+)
+
+// Drop reads the JPEG images base and insert, replaces the blocks of base at
+// at with the blocks of insert and writes the result into w, like jpegtran
+// -drop. The rest of base is not decoded, so it stays bit-identical.
+//
+// at must be aligned to the iMCU grid of base (multiples of 8 or 16 pixels
+// depending on the subsampling), and insert must have the same color space
+// and sampling factors as base. The part of insert beyond the right or bottom
+// edge of base is dropped. If the quantization tables differ, the blocks of
+// insert are requantized with the tables of base.
+func Drop(base, insert io.Reader, at image.Point, w io.Writer) error {
+	d := new(Decoder)
+	defer d.Close()
+	c, err := d.readCoefficients(base, nil, CopyAll)
+	if err != nil {
+		return err
+	}
+	src, err := d.readCoefficients(insert, nil, CopyNone)
+	if err != nil {
+		return err
+	}
+	if err := dropCoefficients(c, src, at); err != nil {
+		return err
+	}
+	e := new(Encoder)
+	defer e.Close()
+	return e.writeCoefficients(w, c, &CoefficientOptions{ProgressiveMode: c.Progressive, OptimizeCoding: true})
+}
+
+// dropCoefficients copies the blocks of src into dst at at.
+func dropCoefficients(dst, src *Coefficients, at image.Point) error {
+	if !at.In(image.Rect(0, 0, dst.Width, dst.Height)) {
+		return errors.New("drop position is outside of the image")
+	}
+	iMCUWidth, iMCUHeight := dst.iMCUSize()
+	if at.X%iMCUWidth != 0 || at.Y%iMCUHeight != 0 {
+		return fmt.Errorf("drop position is not aligned to the %dx%d iMCU grid", iMCUWidth, iMCUHeight)
+	}
+	if src.ColorSpace != dst.ColorSpace || len(src.Components) != len(dst.Components) {
+		return errors.New("inserted image has a different color space")
+	}
+	for i := range src.Components {
+		s, d := &src.Components[i], &dst.Components[i]
+		if s.HSampFactor != d.HSampFactor || s.VSampFactor != d.VSampFactor {
+			return errors.New("inserted image has different sampling factors")
+		}
+	}
+
+	for i := range dst.Components {
+		d, s := &dst.Components[i], &src.Components[i]
+		srcQ, dstQ := src.QuantTables[s.QuantTable], dst.QuantTables[d.QuantTable]
+		offsetX := at.X / iMCUWidth * d.HSampFactor
+		offsetY := at.Y / iMCUHeight * d.VSampFactor
+		for y := 0; y < s.HeightInBlocks && offsetY+y < d.HeightInBlocks; y++ {
+			for x := 0; x < s.WidthInBlocks && offsetX+x < d.WidthInBlocks; x++ {
+				block, sb := d.Block(offsetX+x, offsetY+y), s.Block(x, y)
+				for k, v := range sb {
+					if srcQ[k] != dstQ[k] {
+						v = requantize(v, srcQ[k], dstQ[k])
+					}
+					block[k] = v
+				}
+			}
+		}
+	}
+	return nil
+}
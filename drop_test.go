@@ -0,0 +1,86 @@
+package jpeg
+
+import (
+	"bytes"
+	"image"
+	"io/ioutil"
+	"testing"
+)
+
+func TestDrop(t *testing.T) {
+	base, err := ioutil.ReadFile("images/kinkaku.jpg")
+	if err != nil {
+		t.Fatalf("reading file: %v", err)
+	}
+	insert, err := ioutil.ReadFile("images/testdata/video-001.q50.420.jpeg")
+	if err != nil {
+		t.Fatalf("reading file: %v", err)
+	}
+	at := image.Pt(32, 48)
+
+	var out bytes.Buffer
+	if err := Drop(bytes.NewReader(base), bytes.NewReader(insert), at, &out); err != nil {
+		t.Fatalf("Drop returns error: %v", err)
+	}
+
+	// The blocks outside of the insert are kept as they are.
+	orig, err := ReadCoefficients(bytes.NewReader(base))
+	if err != nil {
+		t.Fatalf("ReadCoefficients returns error: %v", err)
+	}
+	ins, err := ReadCoefficients(bytes.NewReader(insert))
+	if err != nil {
+		t.Fatalf("ReadCoefficients returns error: %v", err)
+	}
+	c, err := ReadCoefficients(bytes.NewReader(out.Bytes()))
+	if err != nil {
+		t.Fatalf("ReadCoefficients returns error: %v", err)
+	}
+	for i, comp := range c.Components {
+		iMCUWidth, iMCUHeight := c.iMCUSize()
+		inserted := image.Rect(0, 0, ins.Components[i].WidthInBlocks, ins.Components[i].HeightInBlocks).
+			Add(image.Pt(at.X/iMCUWidth*comp.HSampFactor, at.Y/iMCUHeight*comp.VSampFactor))
+		for y := 0; y < comp.HeightInBlocks; y++ {
+			for x := 0; x < comp.WidthInBlocks; x++ {
+				if !image.Pt(x, y).In(inserted) && *comp.Block(x, y) != *orig.Components[i].Block(x, y) {
+					t.Fatalf("component %d: block (%d, %d) changed", i, x, y)
+				}
+			}
+		}
+	}
+
+	img, err := DecodeBytesIntoRGB(out.Bytes(), nil)
+	if err != nil {
+		t.Fatalf("decoding dropped image returns error: %v", err)
+	}
+	src, err := DecodeBytesIntoRGB(insert, nil)
+	if err != nil {
+		t.Fatalf("DecodeIntoRGB returns error: %v", err)
+	}
+	if img.Bounds() != image.Rect(0, 0, 1024, 768) {
+		t.Errorf("got %v, want the size of the base image", img.Bounds())
+	}
+	area := src.Bounds().Add(at)
+	if d := transformDiff(img, area, src, func(x, y, w, h int) (int, int) { return x, y }); d > 4*0x101 {
+		t.Errorf("inserted area differs by %v", d)
+	}
+
+	// The insert is clipped at the edges of the base.
+	if err := Drop(bytes.NewReader(base), bytes.NewReader(insert), image.Pt(960, 720), ioutil.Discard); err != nil {
+		t.Errorf("Drop at the bottom right corner returns error: %v", err)
+	}
+
+	if err := Drop(bytes.NewReader(base), bytes.NewReader(insert), image.Pt(8, 8), ioutil.Discard); err == nil {
+		t.Errorf("Drop at an unaligned position returns no error")
+	}
+	if err := Drop(bytes.NewReader(base), bytes.NewReader(insert), image.Pt(2048, 0), ioutil.Discard); err == nil {
+		t.Errorf("Drop outside of the image returns no error")
+	}
+	gray, err := ioutil.ReadFile("images/testdata/video-005.gray.q50.jpeg")
+	if err != nil {
+		t.Fatalf("reading file: %v", err)
+	}
+	if err := Drop(bytes.NewReader(base), bytes.NewReader(gray), at, ioutil.Discard); err == nil {
+		t.Errorf("Drop of a grayscale image into a color image returns no error")
+	}
+}
@@ -1,3 +1,3 @@
 module github.com/turtletowerz/go-libjpeg
 
-go 1.16
+go 1.21
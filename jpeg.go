@@ -24,6 +24,11 @@ static J_COLOR_SPACE getJCS_EXT_RGBA(void) {
 */
 import "C"
 
+import (
+	"context"
+	"fmt"
+)
+
 // Y/Cb/Cr Planes
 const (
 	Y  = 0
@@ -43,6 +48,39 @@ const (
 	DCTFloat DCTMethod = C.JDCT_FLOAT
 )
 
+const (
+	// DefaultBufferSize is the size of the I/O buffers used when
+	// DecoderOptions.ReadBufferSize or EncoderOptions.WriteBufferSize is zero.
+	DefaultBufferSize = 16384
+	// MinBufferSize is the smallest I/O buffer size. Smaller sizes are rounded up.
+	MinBufferSize = 256
+	// MaxBufferSize is the largest I/O buffer size. Larger sizes are rounded down.
+	MaxBufferSize = 16 << 20
+)
+
+// bufferSize returns the I/O buffer size to use for the requested size.
+func bufferSize(size int) int {
+	switch {
+	case size == 0:
+		return DefaultBufferSize
+	case size < MinBufferSize:
+		return MinBufferSize
+	case size > MaxBufferSize:
+		return MaxBufferSize
+	}
+	return size
+}
+
+// canceled returns an error wrapping ctx.Err() if ctx is done.
+func canceled(ctx context.Context, op string) error {
+	select {
+	case <-ctx.Done():
+		return fmt.Errorf("%s canceled: %w", op, ctx.Err())
+	default:
+		return nil
+	}
+}
+
 func getJCS_EXT_RGBA() C.J_COLOR_SPACE {
 	return C.getJCS_EXT_RGBA()
 }
@@ -2,6 +2,7 @@
 
 #include <stdio.h>
 #include <stdlib.h>
+#include <stdint.h>
 #include <setjmp.h>
 #include "jpeglib.h"
 #include "jerror.h"
@@ -14,6 +15,15 @@ struct my_error_mgr {
 	jmp_buf jmpbuf;
 };
 
+// go_progress_mgr extends jpeg_progress_mgr with a cgo.Handle of the Go
+// ProgressFunc and the limit on the number of scans to read.
+struct go_progress_mgr {
+	struct jpeg_progress_mgr pub;
+	uintptr_t handle;
+	int max_scans;
+	int scan_limit_hit;
+};
+
 #if defined(_WIN32) && !defined(__CYGWIN__)
 // setjmp/longjmp occasionally crashes on Windows
 // see https://github.com/golang/go/issues/13672
@@ -3,15 +3,23 @@ package jpeg
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"image"
 	"image/color"
+	"image/color/palette"
+	"image/draw"
 	nativeJPEG "image/jpeg"
 	"image/png"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"testing/iotest"
+	"time"
 )
 
 var naturalImageFiles = []string{
@@ -89,6 +97,200 @@ func BenchmarkDecode(b *testing.B) {
 	}
 }
 
+func BenchmarkDecoderReuse(b *testing.B) {
+	d := NewDecoder()
+	defer d.Close()
+	for i := 0; i < b.N; i++ {
+		for _, file := range naturalImageFiles {
+			r, err := os.Open(file)
+			if err != nil {
+				b.Errorf("opening file: %v", err)
+			}
+			img, err := d.Decode(r, &DecoderOptions{})
+			if img == nil {
+				b.Error("Got nil")
+			}
+			if err != nil {
+				b.Errorf("Got Error: %v", err)
+			}
+			r.Close()
+		}
+	}
+}
+
+func BenchmarkDecodePooled(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		for _, file := range naturalImageFiles {
+			r, err := os.Open(file)
+			if err != nil {
+				b.Errorf("opening file: %v", err)
+			}
+			d := GetDecoder()
+			img, err := d.Decode(r, &DecoderOptions{})
+			PutDecoder(d)
+			if img == nil {
+				b.Error("Got nil")
+			}
+			if err != nil {
+				b.Errorf("Got Error: %v", err)
+			}
+			r.Close()
+		}
+	}
+}
+
+func BenchmarkDecodeParallel(b *testing.B) {
+	var data [][]byte
+	for _, file := range naturalImageFiles {
+		buf, err := ioutil.ReadFile(file)
+		if err != nil {
+			b.Fatalf("reading file: %v", err)
+		}
+		data = append(data, buf)
+	}
+
+	b.RunParallel(func(pb *testing.PB) {
+		d := NewDecoder()
+		defer d.Close()
+		for pb.Next() {
+			for _, buf := range data {
+				img, err := d.Decode(bytes.NewReader(buf), &DecoderOptions{})
+				if img == nil {
+					b.Error("Got nil")
+				}
+				if err != nil {
+					b.Errorf("Got Error: %v", err)
+				}
+			}
+		}
+	})
+}
+
+func benchmarkDecodeInMemory(b *testing.B, wrap func([]byte) io.Reader) {
+	var data [][]byte
+	for _, file := range naturalImageFiles {
+		buf, err := ioutil.ReadFile(file)
+		if err != nil {
+			b.Fatalf("reading file: %v", err)
+		}
+		data = append(data, buf)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, buf := range data {
+			img, err := Decode(wrap(buf), &DecoderOptions{})
+			if img == nil {
+				b.Error("Got nil")
+			}
+			if err != nil {
+				b.Errorf("Got Error: %v", err)
+			}
+		}
+	}
+}
+
+func BenchmarkDecodeBytes(b *testing.B) {
+	benchmarkDecodeInMemory(b, func(buf []byte) io.Reader {
+		return newBytesReader(buf)
+	})
+}
+
+func BenchmarkDecodeBytesThroughReader(b *testing.B) {
+	benchmarkDecodeInMemory(b, func(buf []byte) io.Reader {
+		return struct{ io.Reader }{bytes.NewReader(buf)}
+	})
+}
+
+func benchmarkEncode(b *testing.B, encode func(img image.Image) error) {
+	r, err := os.Open(naturalImageFiles[0])
+	if err != nil {
+		b.Fatalf("opening file: %v", err)
+	}
+	img, err := Decode(r, &DecoderOptions{})
+	r.Close()
+	if err != nil {
+		b.Fatalf("Decode returns error: %v", err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := encode(img); err != nil {
+			b.Errorf("Got Error: %v", err)
+		}
+	}
+}
+
+func BenchmarkEncode(b *testing.B) {
+	benchmarkEncode(b, func(img image.Image) error {
+		var w bytes.Buffer
+		return Encode(&w, img, &EncoderOptions{Quality: 90})
+	})
+}
+
+func BenchmarkEncodeToBytes(b *testing.B) {
+	benchmarkEncode(b, func(img image.Image) error {
+		_, err := EncodeToBytes(img, &EncoderOptions{Quality: 90})
+		return err
+	})
+}
+
+// slowReader stands in for a network-backed reader where every Read call
+// has a fixed latency.
+type slowReader struct {
+	r       io.Reader
+	latency time.Duration
+}
+
+func (s *slowReader) Read(p []byte) (int, error) {
+	time.Sleep(s.latency)
+	return s.r.Read(p)
+}
+
+func BenchmarkDecodeReadBufferSize(b *testing.B) {
+	data, err := ioutil.ReadFile(naturalImageFiles[0])
+	if err != nil {
+		b.Fatalf("reading file: %v", err)
+	}
+
+	for _, size := range []int{1024, 4096, DefaultBufferSize, 65536, 262144} {
+		b.Run(fmt.Sprintf("%d", size), func(b *testing.B) {
+			d := NewDecoder()
+			defer d.Close()
+			for i := 0; i < b.N; i++ {
+				r := &slowReader{bytes.NewReader(data), 50 * time.Microsecond}
+				if _, err := d.Decode(r, &DecoderOptions{ReadBufferSize: size}); err != nil {
+					b.Errorf("Got Error: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkEncodeWriteBufferSize(b *testing.B) {
+	r, err := os.Open(naturalImageFiles[0])
+	if err != nil {
+		b.Fatalf("opening file: %v", err)
+	}
+	img, err := Decode(r, &DecoderOptions{})
+	r.Close()
+	if err != nil {
+		b.Fatalf("Decode returns error: %v", err)
+	}
+
+	for _, size := range []int{1024, 4096, DefaultBufferSize, 65536, 262144} {
+		b.Run(fmt.Sprintf("%d", size), func(b *testing.B) {
+			e := NewEncoder()
+			defer e.Close()
+			for i := 0; i < b.N; i++ {
+				if err := e.Encode(ioutil.Discard, img, &EncoderOptions{Quality: 90, WriteBufferSize: size}); err != nil {
+					b.Errorf("Got Error: %v", err)
+				}
+			}
+		})
+	}
+}
+
 func BenchmarkDecodeIntoRGB(b *testing.B) {
 	for i := 0; i < b.N; i++ {
 		for _, file := range naturalImageFiles {
@@ -142,6 +344,154 @@ func TestDecode(t *testing.T) {
 	}
 }
 
+func TestDecoderReuse(t *testing.T) {
+	d := NewDecoder()
+	defer d.Close()
+
+	files := append(append([]string{}, naturalImageFiles...), subsampledImageFiles...)
+	for _, file := range files {
+		fmt.Printf(" - test: %s\n", file)
+
+		// A failed decode must not break the following ones.
+		if _, err := d.Decode(bytes.NewReader([]byte{0xff, 0xd8, 0xff}), &DecoderOptions{}); err == nil {
+			t.Errorf("got no error with broken file")
+		}
+
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatalf("reading file: %v", err)
+		}
+		want, err := Decode(bytes.NewReader(data), &DecoderOptions{})
+		if err != nil {
+			t.Fatalf("Decode returns error: %v", err)
+		}
+		got, err := d.Decode(bytes.NewReader(data), &DecoderOptions{})
+		if err != nil {
+			t.Fatalf("Decoder.Decode returns error: %v", err)
+		}
+		if _, err := MatchImage(want, got, 0); err != nil {
+			t.Errorf("%s: reused decoder differs from Decode: %v", file, err)
+		}
+
+		config, err := d.DecodeConfig(bytes.NewReader(data))
+		if err != nil {
+			t.Errorf("Decoder.DecodeConfig returns error: %v", err)
+		}
+		if config.Width != want.Bounds().Dx() || config.Height != want.Bounds().Dy() {
+			t.Errorf("%s: got config %dx%d, want %v", file, config.Width, config.Height, want.Bounds())
+		}
+	}
+}
+
+func TestEncoderReuse(t *testing.T) {
+	e := GetEncoder()
+	defer PutEncoder(e)
+
+	for _, file := range subsampledImageFiles {
+		fmt.Printf(" - test: %s\n", file)
+		r, err := os.Open(file)
+		if err != nil {
+			t.Fatalf("opening file: %v", err)
+		}
+		img, err := Decode(r, &DecoderOptions{})
+		r.Close()
+		if err != nil {
+			t.Fatalf("Decode returns error: %v", err)
+		}
+
+		if err := e.Encode(ioutil.Discard, &image.YCbCr{}, &EncoderOptions{}); err == nil {
+			t.Errorf("got no error with empty image")
+		}
+
+		var want, got bytes.Buffer
+		if err := Encode(&want, img, &EncoderOptions{Quality: 90}); err != nil {
+			t.Fatalf("Encode returns error: %v", err)
+		}
+		if err := e.Encode(&got, img, &EncoderOptions{Quality: 90}); err != nil {
+			t.Fatalf("Encoder.Encode returns error: %v", err)
+		}
+		if !bytes.Equal(want.Bytes(), got.Bytes()) {
+			t.Errorf("%s: reused encoder output differs from Encode", file)
+		}
+
+		// Optimized coding must not leave its Huffman tables behind for the
+		// next image.
+		if err := e.Encode(ioutil.Discard, img, &EncoderOptions{Quality: 90, OptimizeCoding: true, ProgressiveMode: true}); err != nil {
+			t.Fatalf("Encoder.Encode returns error: %v", err)
+		}
+		got.Reset()
+		if err := e.Encode(&got, img, &EncoderOptions{Quality: 90}); err != nil {
+			t.Fatalf("Encoder.Encode returns error: %v", err)
+		}
+		if !bytes.Equal(want.Bytes(), got.Bytes()) {
+			t.Errorf("%s: encoder output after optimized coding differs from Encode", file)
+		}
+	}
+}
+
+func TestDecodeBytes(t *testing.T) {
+	for _, file := range append(append([]string{}, naturalImageFiles...), subsampledImageFiles...) {
+		fmt.Printf(" - test: %s\n", file)
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatalf("reading file: %v", err)
+		}
+
+		// Hide the concrete type to force the buffered path.
+		want, err := Decode(struct{ io.Reader }{bytes.NewReader(data)}, &DecoderOptions{})
+		if err != nil {
+			t.Fatalf("Decode returns error: %v", err)
+		}
+		got, err := DecodeBytes(data, &DecoderOptions{})
+		if err != nil {
+			t.Fatalf("DecodeBytes returns error: %v", err)
+		}
+		if _, err := MatchImage(want, got, 0); err != nil {
+			t.Errorf("%s: DecodeBytes differs from Decode: %v", file, err)
+		}
+
+		rgb, err := DecodeBytesIntoRGB(data, &DecoderOptions{})
+		if err != nil {
+			t.Errorf("DecodeBytesIntoRGB returns error: %v", err)
+		} else if !rgb.Bounds().Eq(want.Bounds()) {
+			t.Errorf("%s: got bounds %v, want %v", file, rgb.Bounds(), want.Bounds())
+		}
+
+		// The readers must be left just after the decoded image.
+		trailer := "trailing data"
+		buf := bytes.NewBuffer(append(append([]byte{}, data...), trailer...))
+		if _, err := Decode(buf, &DecoderOptions{}); err != nil {
+			t.Fatalf("Decode returns error: %v", err)
+		}
+		if rest := buf.String(); !strings.HasSuffix(rest, trailer) || len(rest) > len(trailer)+2 {
+			t.Errorf("%s: bytes.Buffer left with %q", file, rest)
+		}
+		r := newBytesReader(append(append([]byte{}, data...), trailer...))
+		if _, err := DecodeConfig(r); err != nil {
+			t.Fatalf("DecodeConfig returns error: %v", err)
+		}
+		if r.Len() <= len(trailer) || r.Len() >= len(data) {
+			t.Errorf("%s: bytesReader left with %d bytes", file, r.Len())
+		}
+
+		// A *bytes.Reader is read through the buffer like any other reader.
+		got, err = Decode(bytes.NewReader(data), &DecoderOptions{})
+		if err != nil {
+			t.Fatalf("Decode returns error: %v", err)
+		}
+		if _, err := MatchImage(want, got, 0); err != nil {
+			t.Errorf("%s: decoding a bytes.Reader differs from Decode: %v", file, err)
+		}
+	}
+
+	if _, err := DecodeBytes(nil, &DecoderOptions{}); err == nil {
+		t.Errorf("got no error with blank data")
+	}
+	if _, err := DecodeBytes([]byte{0xff, 0xd8}, &DecoderOptions{}); err == nil {
+		t.Errorf("got no error with truncated data")
+	}
+}
+
 func TestDecodeScaled(t *testing.T) {
 	for _, file := range naturalImageFiles {
 		r, err := os.Open(file)
@@ -165,6 +515,167 @@ func TestDecodeScaled(t *testing.T) {
 	}
 }
 
+// meanDiff returns the mean absolute difference of the 16-bit RGB channels of
+// a and b.
+func meanDiff(a, b image.Image) float64 {
+	var sum, n float64
+	bounds := a.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r0, g0, b0, _ := a.At(x, y).RGBA()
+			r1, g1, b1, _ := b.At(x, y).RGBA()
+			sum += float64(delta2(r0, r1)+delta2(g0, g1)+delta2(b0, b1)) / 3
+			n++
+		}
+	}
+	return sum / n
+}
+
+func TestDecodeScaleFactors(t *testing.T) {
+	files := append(append([]string{}, naturalImageFiles...), subsampledImageFiles...)
+	files = append(files, "images/testdata/video-001.progressive.jpeg", "images/testdata/video-005.gray.jpeg")
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatalf("reading file: %v", err)
+		}
+		config, err := DecodeBytesConfig(data)
+		if err != nil {
+			t.Fatalf("DecodeConfig returns error: %v", err)
+		}
+		for n := 1; n <= 16; n++ {
+			options := &DecoderOptions{Scale: Scale{n, 8}}
+			w, h := ScaledSize(config, options)
+			if want := (config.Width*n + 7) / 8; w != want {
+				t.Errorf("%s: ScaledSize width at %d/8: got %d, want %d", file, n, w, want)
+			}
+
+			img, err := DecodeBytes(data, options)
+			if err != nil {
+				t.Fatalf("%s: Decode at %d/8 returns error: %v", file, n, err)
+			}
+			if got := img.Bounds(); got.Dx() != w || got.Dy() != h {
+				t.Errorf("%s: Decode at %d/8: got %v, want %dx%d", file, n, got, w, h)
+			}
+			rgb, err := DecodeBytesIntoRGB(data, options)
+			if err != nil {
+				t.Fatalf("%s: DecodeIntoRGB at %d/8 returns error: %v", file, n, err)
+			}
+			if got := rgb.Bounds(); got.Dx() != w || got.Dy() != h {
+				t.Errorf("%s: DecodeIntoRGB at %d/8: got %v, want %dx%d", file, n, got, w, h)
+			}
+			// The planes are upsampled differently, so allow some
+			// difference around the chroma edges of the checkerboards.
+			if d := meanDiff(img, rgb); d > 16*0x101 {
+				t.Errorf("%s: Decode and DecodeIntoRGB at %d/8 differ by %v", file, n, d)
+			}
+		}
+	}
+}
+
+func TestScaledSize(t *testing.T) {
+	config := image.Config{Width: 1024, Height: 768}
+	target := image.Rect(0, 0, 300, 300)
+	tests := []struct {
+		options *DecoderOptions
+		w, h    int
+	}{
+		{nil, 1024, 768},
+		{&DecoderOptions{}, 1024, 768},
+		{&DecoderOptions{ScaleTarget: target}, 512, 384},
+		{&DecoderOptions{ScaleTarget: target, ScaleMode: ScaleFit}, 256, 192},
+		{&DecoderOptions{ScaleTarget: target, ScaleMode: ScaleNearest}, 384, 288},
+		{&DecoderOptions{ScaleTarget: image.Rect(0, 0, 2000, 1000)}, 1024, 768},
+		{&DecoderOptions{ScaleTarget: image.Rect(0, 0, 2000, 1000), AllowUpscale: true}, 2048, 1536},
+		{&DecoderOptions{ScaleTarget: image.Rect(0, 0, 2000, 1000), ScaleMode: ScaleFit, AllowUpscale: true}, 1280, 960},
+		{&DecoderOptions{ScaleTarget: image.Rect(0, 0, 10, 10), ScaleMode: ScaleFit}, 128, 96},
+		{&DecoderOptions{Scale: Scale{1, 3}, ScaleTarget: target}, 384, 288},
+		{&DecoderOptions{Scale: Scale{3, 1}}, 2048, 1536},
+		{&DecoderOptions{Scale: Scale{1, 100}}, 128, 96},
+	}
+	for _, test := range tests {
+		w, h := ScaledSize(config, test.options)
+		if w != test.w || h != test.h {
+			t.Errorf("ScaledSize with %+v: got %dx%d, want %dx%d", test.options, w, h, test.w, test.h)
+		}
+	}
+}
+
+func TestThumbnail(t *testing.T) {
+	files := append(append([]string{}, naturalImageFiles...), subsampledImageFiles...)
+	files = append(files, "images/testdata/video-001.progressive.jpeg", "images/testdata/video-005.gray.jpeg")
+	tests := []struct {
+		mode ThumbnailMode
+		w, h int
+	}{
+		{ThumbnailFit, 100, 100},
+		{ThumbnailFill, 100, 100},
+		{ThumbnailCrop, 100, 100},
+		{ThumbnailCrop, 37, 201},
+		{ThumbnailFit, 3000, 10},
+	}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatalf("reading file: %v", err)
+		}
+		full, err := DecodeBytes(data, nil)
+		if err != nil {
+			t.Fatalf("Decode returns error: %v", err)
+		}
+		fb := full.Bounds()
+
+		for _, test := range tests {
+			for _, filter := range []Filter{Lanczos3, CatmullRom, Box} {
+				img, err := Thumbnail(bytes.NewReader(data), test.w, test.h, &ThumbnailOptions{Mode: test.mode, Filter: filter})
+				if err != nil {
+					t.Fatalf("%s: Thumbnail returns error: %v", file, err)
+				}
+				b := img.Bounds()
+				switch test.mode {
+				case ThumbnailFit:
+					if b.Dx() > test.w || b.Dy() > test.h || (b.Dx() != test.w && b.Dy() != test.h) {
+						t.Errorf("%s: fit %dx%d: got %v", file, test.w, test.h, b)
+					}
+				default:
+					if b.Dx() != test.w || b.Dy() != test.h {
+						t.Errorf("%s: mode %d %dx%d: got %v", file, test.mode, test.w, test.h, b)
+					}
+				}
+				if _, err := EncodeToBytes(img, &EncoderOptions{Quality: 90}); err != nil {
+					t.Errorf("%s: Encode returns error: %v", file, err)
+				}
+				// The checkerboards alias too much to be compared with
+				// single pixels.
+				if test.mode == ThumbnailCrop || strings.Contains(file, "checkerboard") {
+					continue
+				}
+
+				// Compare the colors with the nearest pixels of the full size
+				// image.
+				var sum, n float64
+				for y := 0; y < b.Dy(); y++ {
+					for x := 0; x < b.Dx(); x++ {
+						sx := fb.Min.X + (2*x+1)*fb.Dx()/(2*b.Dx())
+						sy := fb.Min.Y + (2*y+1)*fb.Dy()/(2*b.Dy())
+						r0, g0, b0, _ := img.At(x, y).RGBA()
+						r1, g1, b1, _ := full.At(sx, sy).RGBA()
+						sum += float64(delta2(r0, r1)+delta2(g0, g1)+delta2(b0, b1)) / 3
+						n++
+					}
+				}
+				if d := sum / n; d > 32*0x101 {
+					t.Errorf("%s: %dx%d with filter %d differs from the original by %v", file, test.w, test.h, filter, d)
+				}
+			}
+		}
+	}
+
+	if _, err := Thumbnail(bytes.NewReader(nil), 0, 10, nil); err == nil {
+		t.Errorf("Thumbnail with an empty size returns no error")
+	}
+}
+
 func TestDecodeIntoRGBA(t *testing.T) {
 	if SupportRGBA() != true {
 		t.Skipf("This build is not support DecodeIntoRGBA.")
@@ -315,6 +826,327 @@ func TestDecodeAndEncodeSubsampledImages(t *testing.T) {
 	}
 }
 
+func TestEncodeToBytes(t *testing.T) {
+	e := NewEncoder()
+	defer e.Close()
+
+	for _, file := range naturalImageFiles {
+		fmt.Printf(" - test: %s\n", file)
+		r, err := os.Open(file)
+		if err != nil {
+			t.Fatalf("opening file: %v", err)
+		}
+		img, err := Decode(r, &DecoderOptions{})
+		r.Close()
+		if err != nil {
+			t.Fatalf("Decode returns error: %v", err)
+		}
+
+		// Quality 100 needs several grows of the in-memory buffer.
+		for _, quality := range []int{100, 50} {
+			var want bytes.Buffer
+			if err := Encode(&want, img, &EncoderOptions{Quality: quality}); err != nil {
+				t.Fatalf("Encode returns error: %v", err)
+			}
+
+			got, err := EncodeToBytes(img, &EncoderOptions{Quality: quality})
+			if err != nil {
+				t.Fatalf("EncodeToBytes returns error: %v", err)
+			}
+			if !bytes.Equal(want.Bytes(), got) {
+				t.Errorf("%s: EncodeToBytes differs from Encode", file)
+			}
+
+			prefix := []byte("prefix")
+			got, err = e.AppendEncode(prefix, img, &EncoderOptions{Quality: quality})
+			if err != nil {
+				t.Fatalf("AppendEncode returns error: %v", err)
+			}
+			if !bytes.HasPrefix(got, prefix) || !bytes.Equal(want.Bytes(), got[len(prefix):]) {
+				t.Errorf("%s: AppendEncode differs from Encode", file)
+			}
+		}
+	}
+
+	if got, err := EncodeToBytes(&image.YCbCr{}, &EncoderOptions{}); err == nil {
+		t.Errorf("got no error with empty image")
+	} else if got != nil {
+		t.Errorf("got %d bytes with empty image", len(got))
+	}
+}
+
+func TestBufferSizes(t *testing.T) {
+	data, err := ioutil.ReadFile(naturalImageFiles[0])
+	if err != nil {
+		t.Fatalf("reading file: %v", err)
+	}
+	want, err := DecodeBytes(data, &DecoderOptions{})
+	if err != nil {
+		t.Fatalf("DecodeBytes returns error: %v", err)
+	}
+	wantJPEG, err := EncodeToBytes(want, &EncoderOptions{Quality: 90})
+	if err != nil {
+		t.Fatalf("EncodeToBytes returns error: %v", err)
+	}
+
+	d := NewDecoder()
+	defer d.Close()
+	e := NewEncoder()
+	defer e.Close()
+	for _, size := range []int{1, MinBufferSize, 1000, DefaultBufferSize, 1 << 20, MaxBufferSize + 1} {
+		r := iotest.HalfReader(bytes.NewReader(data))
+		got, err := d.Decode(r, &DecoderOptions{ReadBufferSize: size})
+		if err != nil {
+			t.Fatalf("ReadBufferSize %d: Decode returns error: %v", size, err)
+		}
+		if _, err := MatchImage(want, got, 0); err != nil {
+			t.Errorf("ReadBufferSize %d: %v", size, err)
+		}
+
+		var w bytes.Buffer
+		if err := e.Encode(&w, want, &EncoderOptions{Quality: 90, WriteBufferSize: size}); err != nil {
+			t.Fatalf("WriteBufferSize %d: Encode returns error: %v", size, err)
+		}
+		if !bytes.Equal(wantJPEG, w.Bytes()) {
+			t.Errorf("WriteBufferSize %d: encoded data differs", size)
+		}
+		gotJPEG, err := e.AppendEncode(nil, want, &EncoderOptions{Quality: 90, WriteBufferSize: size})
+		if err != nil {
+			t.Fatalf("WriteBufferSize %d: AppendEncode returns error: %v", size, err)
+		}
+		if !bytes.Equal(wantJPEG, gotJPEG) {
+			t.Errorf("WriteBufferSize %d: in-memory encoded data differs", size)
+		}
+	}
+}
+
+// cancelingReader cancels a context on its first Read.
+type cancelingReader struct {
+	r      io.Reader
+	cancel context.CancelFunc
+}
+
+func (c *cancelingReader) Read(p []byte) (int, error) {
+	c.cancel()
+	return c.r.Read(p)
+}
+
+// cancelingWriter cancels a context on its first Write.
+type cancelingWriter struct {
+	w      io.Writer
+	cancel context.CancelFunc
+}
+
+func (c *cancelingWriter) Write(p []byte) (int, error) {
+	c.cancel()
+	return c.w.Write(p)
+}
+
+func TestDecodeContext(t *testing.T) {
+	d := NewDecoder()
+	defer d.Close()
+
+	files := append(append([]string{}, naturalImageFiles...), "images/testdata/video-001.progressive.jpeg", "images/testdata/video-005.gray.jpeg")
+	for _, file := range files {
+		fmt.Printf(" - test: %s\n", file)
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatalf("reading file: %v", err)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if _, err := DecodeContext(ctx, bytes.NewReader(data), &DecoderOptions{}); !errors.Is(err, context.Canceled) {
+			t.Errorf("%s: got %v with canceled context", file, err)
+		}
+
+		ctx, cancel = context.WithCancel(context.Background())
+		r := &cancelingReader{bytes.NewReader(data), cancel}
+		if _, err := d.DecodeContext(ctx, r, &DecoderOptions{ReadBufferSize: MinBufferSize}); !errors.Is(err, context.Canceled) {
+			t.Errorf("%s: got %v when canceled while decoding", file, err)
+		}
+
+		// The decoder must still work after being canceled.
+		if _, err := d.DecodeContext(context.Background(), bytes.NewReader(data), &DecoderOptions{}); err != nil {
+			t.Errorf("%s: Decode after cancellation returns error: %v", file, err)
+		}
+	}
+}
+
+func TestEncodeContext(t *testing.T) {
+	e := NewEncoder()
+	defer e.Close()
+
+	src := image.NewGray(image.Rect(0, 0, 1000, 1000))
+	for i := range src.Pix {
+		src.Pix[i] = uint8(i * 7919)
+	}
+	images := []image.Image{src, newRGBA(), NewYCbCrAligned(image.Rect(0, 0, 1000, 1000), image.YCbCrSubsampleRatio420)}
+	for _, img := range images {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if err := EncodeContext(ctx, ioutil.Discard, img, &EncoderOptions{Quality: 90}); !errors.Is(err, context.Canceled) {
+			t.Errorf("%T: got %v with canceled context", img, err)
+		}
+
+		if img.Bounds().Dx() < 1000 {
+			continue
+		}
+		ctx, cancel = context.WithCancel(context.Background())
+		w := &cancelingWriter{ioutil.Discard, cancel}
+		if err := e.EncodeContext(ctx, w, img, &EncoderOptions{Quality: 100, WriteBufferSize: MinBufferSize}); !errors.Is(err, context.Canceled) {
+			t.Errorf("%T: got %v when canceled while encoding", img, err)
+		}
+
+		if err := e.EncodeContext(context.Background(), ioutil.Discard, img, &EncoderOptions{Quality: 90}); err != nil {
+			t.Errorf("%T: Encode after cancellation returns error: %v", img, err)
+		}
+	}
+}
+
+type progressCall struct {
+	pass, totalPasses int
+	done, total       int64
+}
+
+func checkProgress(t *testing.T, name string, reports []progressCall) {
+	if len(reports) == 0 {
+		t.Errorf("%s: progress was not reported", name)
+		return
+	}
+	for i, r := range reports {
+		if r.pass < 0 || r.pass > r.totalPasses || r.done < 0 || r.done > r.total {
+			t.Errorf("%s: invalid progress report %+v", name, r)
+		}
+		if i > 0 && r.pass < reports[i-1].pass {
+			t.Errorf("%s: completed passes went back from %d to %d", name, reports[i-1].pass, r.pass)
+		}
+	}
+}
+
+func TestProgress(t *testing.T) {
+	var reports []progressCall
+	progress := func(pass, totalPasses int, done, total int64) {
+		reports = append(reports, progressCall{pass, totalPasses, done, total})
+	}
+
+	files := []string{"images/kinkaku.jpg", "images/testdata/video-001.progressive.jpeg"}
+	for _, file := range files {
+		fmt.Printf(" - test: %s\n", file)
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatalf("reading file: %v", err)
+		}
+
+		reports = nil
+		img, err := DecodeBytes(data, &DecoderOptions{Progress: progress})
+		if err != nil {
+			t.Fatalf("Decode returns error: %v", err)
+		}
+		checkProgress(t, file, reports)
+
+		reports = nil
+		if _, err := DecodeBytesIntoRGB(data, &DecoderOptions{Progress: progress}); err != nil {
+			t.Fatalf("DecodeIntoRGB returns error: %v", err)
+		}
+		checkProgress(t, file, reports)
+
+		reports = nil
+		if _, err := EncodeToBytes(img, &EncoderOptions{Quality: 90, OptimizeCoding: true, Progress: progress}); err != nil {
+			t.Fatalf("Encode returns error: %v", err)
+		}
+		checkProgress(t, file, reports)
+		if last := reports[len(reports)-1]; last.totalPasses < 2 {
+			t.Errorf("%s: optimized encoding reported %d passes", file, last.totalPasses)
+		}
+
+		// Progress must not be reported once the callback is gone.
+		reports = nil
+		if _, err := DecodeBytes(data, &DecoderOptions{}); err != nil {
+			t.Fatalf("Decode returns error: %v", err)
+		}
+		if len(reports) != 0 {
+			t.Errorf("%s: got %d reports without a callback", file, len(reports))
+		}
+	}
+}
+
+// withSize returns a copy of the JPEG data with the frame dimensions in the
+// SOF marker replaced.
+func withSize(t *testing.T, data []byte, width, height int) []byte {
+	data = append([]byte{}, data...)
+	for i := 2; i+9 < len(data); {
+		if data[i] != 0xff {
+			t.Fatalf("unexpected byte at %d", i)
+		}
+		marker := data[i+1]
+		if marker >= 0xc0 && marker <= 0xc2 {
+			data[i+5], data[i+6] = byte(height>>8), byte(height)
+			data[i+7], data[i+8] = byte(width>>8), byte(width)
+			return data
+		}
+		i += 2 + int(data[i+2])<<8 + int(data[i+3])
+	}
+	t.Fatalf("SOF marker not found")
+	return nil
+}
+
+func TestLimits(t *testing.T) {
+	data, err := ioutil.ReadFile("images/kinkaku.jpg")
+	if err != nil {
+		t.Fatalf("reading file: %v", err)
+	}
+	bomb := withSize(t, data, 60000, 60000)
+
+	for _, options := range []*DecoderOptions{
+		{MaxPixels: 100 << 20},
+		{MaxWidth: 16384},
+		{MaxHeight: 16384},
+	} {
+		_, err := DecodeBytes(bomb, options)
+		if !errors.Is(err, ErrLimitExceeded) {
+			t.Errorf("Decode with %+v: got %v, want ErrLimitExceeded", options, err)
+		}
+		_, err = DecodeBytesIntoRGB(bomb, options)
+		if !errors.Is(err, ErrLimitExceeded) {
+			t.Errorf("DecodeIntoRGB with %+v: got %v, want ErrLimitExceeded", options, err)
+		}
+		_, err = DecodeBytesIntoRGBA(bomb, options)
+		if !errors.Is(err, ErrLimitExceeded) {
+			t.Errorf("DecodeIntoRGBA with %+v: got %v, want ErrLimitExceeded", options, err)
+		}
+		var limitErr *LimitError
+		if !errors.As(err, &limitErr) || limitErr.Value <= limitErr.Max {
+			t.Errorf("DecodeIntoRGBA with %+v: got %v, want a LimitError", options, err)
+		}
+	}
+
+	// Limits above the image size do not get in the way.
+	if _, err := DecodeBytes(data, &DecoderOptions{MaxPixels: 100 << 20, MaxWidth: 16384, MaxHeight: 16384, MaxScans: 100}); err != nil {
+		t.Errorf("Decode returns error: %v", err)
+	}
+
+	progressive, err := ioutil.ReadFile("images/testdata/video-001.progressive.jpeg")
+	if err != nil {
+		t.Fatalf("reading file: %v", err)
+	}
+	d := NewDecoder()
+	defer d.Close()
+	_, err = d.Decode(bytes.NewReader(progressive), &DecoderOptions{MaxScans: 2})
+	var limitErr *LimitError
+	if !errors.As(err, &limitErr) || limitErr.Limit != "MaxScans" {
+		t.Errorf("Decode with MaxScans: got %v, want a MaxScans LimitError", err)
+	}
+	_, err = d.Decode(bytes.NewReader(progressive), &DecoderOptions{MaxMemory: 1024})
+	if !errors.As(err, &limitErr) || limitErr.Limit != "MaxMemory" {
+		t.Errorf("Decode with MaxMemory: got %v, want a MaxMemory LimitError", err)
+	}
+	// The limits must not stick to a reused Decoder.
+	if _, err := d.Decode(bytes.NewReader(progressive), nil); err != nil {
+		t.Errorf("Decode returns error: %v", err)
+	}
+}
+
 func TestEncodeGrayImage(t *testing.T) {
 	w, h := 400, 200
 	img := image.NewGray(image.Rect(0, 0, w, h))
@@ -480,6 +1312,323 @@ func TestEncodeRGBA(t *testing.T) {
 	}
 }
 
+// opaqueImage hides the concrete type of an image from Encode.
+type opaqueImage struct{ image.Image }
+
+func TestEncodeImageTypes(t *testing.T) {
+	data, err := ioutil.ReadFile("images/kinkaku.jpg")
+	if err != nil {
+		t.Fatalf("reading file: %v", err)
+	}
+	src, err := DecodeBytesIntoRGB(data, nil)
+	if err != nil {
+		t.Fatalf("DecodeIntoRGB returns error: %v", err)
+	}
+	b := src.Bounds()
+	convert := func(dst draw.Image) image.Image {
+		draw.Draw(dst, dst.Bounds(), src, b.Min, draw.Src)
+		return dst
+	}
+	sub := image.Rect(100, 200, 612, 584)
+	// A color.Palette may hold more than the 256 colors a Paletted image can
+	// index. The extra entries repeat black so that draw never picks them.
+	long := append(color.Palette{}, palette.Plan9...)
+	for len(long) < 300 {
+		long = append(long, palette.Plan9[0])
+	}
+	tests := []struct {
+		name string
+		img  image.Image
+		gray bool
+		// max is the mean difference allowed from src.
+		max float64
+	}{
+		{"NRGBA", convert(image.NewNRGBA(b)), false, 2 * 0x101},
+		{"NRGBA sub-image", convert(image.NewNRGBA(b)).(*image.NRGBA).SubImage(sub), false, 2 * 0x101},
+		{"Paletted", convert(image.NewPaletted(b, palette.Plan9)), false, 16 * 0x101},
+		{"Paletted with 300 colors", convert(image.NewPaletted(b, long)), false, 16 * 0x101},
+		{"Gray16", convert(image.NewGray16(b)), true, 0},
+		{"RGBA64", convert(image.NewRGBA64(b)), false, 2 * 0x101},
+		{"NRGBA64", convert(image.NewNRGBA64(b)), false, 2 * 0x101},
+		{"custom", opaqueImage{src}, false, 2 * 0x101},
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		if err := Encode(&buf, test.img, &EncoderOptions{Quality: 95}); err != nil {
+			t.Fatalf("%s: Encode returns error: %v", test.name, err)
+		}
+		img, err := Decode(&buf, nil)
+		if err != nil {
+			t.Fatalf("%s: Decode returns error: %v", test.name, err)
+		}
+		if img.Bounds().Size() != test.img.Bounds().Size() {
+			t.Errorf("%s: got %v, want the size of %v", test.name, img.Bounds(), test.img.Bounds())
+			continue
+		}
+		if _, ok := img.(*image.Gray); ok != test.gray {
+			t.Errorf("%s: decoded %T", test.name, img)
+		}
+		if test.gray {
+			continue
+		}
+		d := transformDiff(img, img.Bounds(), src, func(x, y, w, h int) (int, int) {
+			return test.img.Bounds().Min.X + x, test.img.Bounds().Min.Y + y
+		})
+		if d > test.max {
+			t.Errorf("%s: differs by %v", test.name, d)
+		}
+	}
+
+}
+
+func TestEncodeBackground(t *testing.T) {
+	half := color.NRGBA{0xff, 0, 0, 0x80}
+	fill := func(img draw.Image) draw.Image {
+		b := img.Bounds()
+		draw.Draw(img, image.Rect(b.Min.X, b.Min.Y, b.Min.X+16, b.Max.Y), image.Transparent, image.Point{}, draw.Src)
+		draw.Draw(img, image.Rect(b.Min.X+16, b.Min.Y, b.Max.X, b.Max.Y), image.NewUniform(half), image.Point{}, draw.Src)
+		return img
+	}
+	r := image.Rect(0, 0, 32, 16)
+	images := []image.Image{
+		fill(image.NewRGBA(r)),
+		fill(image.NewNRGBA(r)),
+		fill(image.NewRGBA64(r)),
+		fill(image.NewNRGBA64(r)),
+		opaqueImage{fill(image.NewNRGBA(r))},
+		fill(image.NewPaletted(r, color.Palette{color.Transparent, half})),
+	}
+	tests := []struct {
+		bg                color.Color
+		transparent, over color.RGBA
+	}{
+		{nil, color.RGBA{0xff, 0xff, 0xff, 0xff}, color.RGBA{0xff, 0x7f, 0x7f, 0xff}},
+		{color.Black, color.RGBA{0, 0, 0, 0xff}, color.RGBA{0x80, 0, 0, 0xff}},
+		{color.RGBA{0, 0, 0xff, 0xff}, color.RGBA{0, 0, 0xff, 0xff}, color.RGBA{0x80, 0, 0x7f, 0xff}},
+	}
+	near := func(c color.Color, want color.RGBA) bool {
+		r, g, b, _ := c.RGBA()
+		return delta(uint8(r>>8), want.R) <= 4 && delta(uint8(g>>8), want.G) <= 4 && delta(uint8(b>>8), want.B) <= 4
+	}
+	for _, img := range images {
+		for _, test := range tests {
+			var buf bytes.Buffer
+			if err := Encode(&buf, img, &EncoderOptions{Quality: 100, Background: test.bg}); err != nil {
+				t.Fatalf("%T: Encode returns error: %v", img, err)
+			}
+			decoded, err := DecodeIntoRGB(&buf, nil)
+			if err != nil {
+				t.Fatalf("%T: Decode returns error: %v", img, err)
+			}
+			if c := decoded.At(4, 8); !near(c, test.transparent) {
+				t.Errorf("%T: background %v: transparent pixel is %v, want %v", img, test.bg, c, test.transparent)
+			}
+			if c := decoded.At(28, 8); !near(c, test.over) {
+				t.Errorf("%T: background %v: translucent pixel is %v, want %v", img, test.bg, c, test.over)
+			}
+		}
+	}
+}
+
+func TestEncodeCMYK(t *testing.T) {
+	data, err := ioutil.ReadFile("images/kinkaku.jpg")
+	if err != nil {
+		t.Fatalf("reading file: %v", err)
+	}
+	src, err := DecodeBytesIntoRGB(data, nil)
+	if err != nil {
+		t.Fatalf("DecodeIntoRGB returns error: %v", err)
+	}
+	cmyk := image.NewCMYK(src.Bounds())
+	draw.Draw(cmyk, cmyk.Bounds(), src, image.Point{}, draw.Src)
+
+	for _, test := range []struct {
+		options   EncoderOptions
+		transform byte
+	}{
+		{EncoderOptions{Quality: 95}, 0},
+		{EncoderOptions{Quality: 95, YCCK: true}, 2},
+		{EncoderOptions{Quality: 95, YCCK: true, ProgressiveMode: true}, 2},
+	} {
+		var buf bytes.Buffer
+		if err := Encode(&buf, cmyk, &test.options); err != nil {
+			t.Fatalf("%+v: Encode returns error: %v", test.options, err)
+		}
+		i := bytes.Index(buf.Bytes(), []byte("Adobe"))
+		if i < 0 || i+11 >= buf.Len() {
+			t.Fatalf("%+v: no Adobe marker", test.options)
+		}
+		if got := buf.Bytes()[i+11]; got != test.transform {
+			t.Errorf("%+v: Adobe transform is %d, want %d", test.options, got, test.transform)
+		}
+
+		// image/jpeg reads the inverted inks of Adobe CMYK images.
+		img, err := nativeJPEG.Decode(&buf)
+		if err != nil {
+			t.Fatalf("%+v: image/jpeg returns error: %v", test.options, err)
+		}
+		if _, ok := img.(*image.CMYK); !ok {
+			t.Fatalf("%+v: got %T, want *image.CMYK", test.options, img)
+		}
+		if d := meanDiff(img, src); d > 4*0x101 {
+			t.Errorf("%+v: differs by %v", test.options, d)
+		}
+	}
+}
+
+func TestEncodeSubImage(t *testing.T) {
+	files := []string{
+		"images/testdata/video-001.q50.420.jpeg",
+		"images/testdata/video-001.q50.422.jpeg",
+		"images/testdata/video-001.q50.440.jpeg",
+		"images/testdata/video-001.q50.444.jpeg",
+		"images/testdata/video-005.gray.q50.jpeg",
+	}
+	rects := []image.Rectangle{
+		image.Rect(0, 0, 64, 48),
+		image.Rect(1, 1, 100, 77),
+		image.Rect(17, 33, 150, 103),
+		image.Rect(3, 2, 11, 9),
+		image.Rect(5, 6, 6, 7),
+	}
+	type subImager interface {
+		SubImage(image.Rectangle) image.Image
+	}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatalf("reading file: %v", err)
+		}
+		img, err := DecodeBytes(data, nil)
+		if err != nil {
+			t.Fatalf("%s: Decode returns error: %v", file, err)
+		}
+		rgba, err := DecodeBytesIntoRGBA(data, nil)
+		if err != nil {
+			t.Fatalf("%s: DecodeIntoRGBA returns error: %v", file, err)
+		}
+		rgb, err := DecodeBytesIntoRGB(data, nil)
+		if err != nil {
+			t.Fatalf("%s: DecodeIntoRGB returns error: %v", file, err)
+		}
+		for _, r := range rects {
+			// RGB has no SubImage, so its sub-image is a copy at r.
+			subRGB := NewRGB(r)
+			for y := r.Min.Y; y < r.Max.Y; y++ {
+				copy(subRGB.Pix[subRGB.PixOffset(r.Min.X, y):], rgb.Pix[rgb.PixOffset(r.Min.X, y):rgb.PixOffset(r.Max.X, y)])
+			}
+			for _, sub := range []image.Image{img.(subImager).SubImage(r), rgba.SubImage(r), subRGB} {
+				var buf bytes.Buffer
+				if err := Encode(&buf, sub, &EncoderOptions{Quality: 95}); err != nil {
+					t.Fatalf("%s: %T %v: Encode returns error: %v", file, sub, r, err)
+				}
+				got, err := DecodeIntoRGB(&buf, nil)
+				if err != nil {
+					t.Fatalf("%s: %T %v: Decode returns error: %v", file, sub, r, err)
+				}
+				if got.Bounds().Size() != r.Size() {
+					t.Errorf("%s: %T %v: got %v", file, sub, r, got.Bounds())
+					continue
+				}
+				identity := func(x, y, w, h int) (int, int) { return x, y }
+				if d := transformDiff(got, got.Bounds(), sub, identity); d > 4*0x101 {
+					t.Errorf("%s: %T %v differs by %v", file, sub, r, d)
+				}
+			}
+		}
+	}
+}
+
+func TestAlignYCbCr(t *testing.T) {
+	// The chroma samples alternate between columns, so a sub-image starting
+	// at an odd x has output samples straddling two source samples.
+	src := image.NewYCbCr(image.Rect(0, 0, 16, 16), image.YCbCrSubsampleRatio420)
+	for i := range src.Cb {
+		src.Cb[i] = uint8(i % 2 * 200)
+		src.Cr[i] = uint8(i%src.CStride) * 10
+	}
+	sub := src.SubImage(image.Rect(1, 2, 9, 8)).(*image.YCbCr)
+	got := alignYCbCr(sub)
+	if got.Rect != image.Rect(0, 0, 8, 6) {
+		t.Fatalf("got %v", got.Rect)
+	}
+	for cy := 0; cy < 3; cy++ {
+		for cx := 0; cx < 4; cx++ {
+			// Output pixels 2cx and 2cx+1 are source pixels 2cx+1 and 2cx+2.
+			wantCb := (int(src.Cb[cx+(cy+1)*src.CStride]) + int(src.Cb[cx+1+(cy+1)*src.CStride]) + 1) / 2
+			wantCr := (int(src.Cr[cx+(cy+1)*src.CStride]) + int(src.Cr[cx+1+(cy+1)*src.CStride]) + 1) / 2
+			i := cy*got.CStride + cx
+			if int(got.Cb[i]) != wantCb || int(got.Cr[i]) != wantCr {
+				t.Errorf("chroma (%d, %d) is %d, %d, want %d, %d", cx, cy, got.Cb[i], got.Cr[i], wantCb, wantCr)
+			}
+		}
+	}
+}
+
+func TestEncodeYCbCrSubsampleRatios(t *testing.T) {
+	data, err := ioutil.ReadFile("images/kinkaku.jpg")
+	if err != nil {
+		t.Fatalf("reading file: %v", err)
+	}
+	src, err := DecodeBytesIntoRGB(data, nil)
+	if err != nil {
+		t.Fatalf("DecodeIntoRGB returns error: %v", err)
+	}
+	tests := []struct {
+		ratio  image.YCbCrSubsampleRatio
+		hs, vs int
+	}{
+		{image.YCbCrSubsampleRatio444, 1, 1},
+		{image.YCbCrSubsampleRatio422, 2, 1},
+		{image.YCbCrSubsampleRatio420, 2, 2},
+		{image.YCbCrSubsampleRatio440, 1, 2},
+		{image.YCbCrSubsampleRatio411, 4, 1},
+		{image.YCbCrSubsampleRatio410, 4, 2},
+	}
+	for _, test := range tests {
+		// Odd sizes leave partial chroma samples at the edges.
+		b := image.Rect(0, 0, 301, 203)
+		img := image.NewYCbCr(b, test.ratio)
+		for y := 0; y < b.Dy(); y++ {
+			for x := 0; x < b.Dx(); x++ {
+				c := src.RGBAt(x, y)
+				yy, cb, cr := color.RGBToYCbCr(c.R, c.G, c.B)
+				img.Y[img.YOffset(x, y)] = yy
+				img.Cb[img.COffset(x, y)] = cb
+				img.Cr[img.COffset(x, y)] = cr
+			}
+		}
+
+		var buf bytes.Buffer
+		if err := Encode(&buf, img, &EncoderOptions{Quality: 95}); err != nil {
+			t.Fatalf("%v: Encode returns error: %v", test.ratio, err)
+		}
+		c, err := ReadCoefficients(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatalf("%v: ReadCoefficients returns error: %v", test.ratio, err)
+		}
+		if y := c.Components[0]; y.HSampFactor != test.hs || y.VSampFactor != test.vs {
+			t.Errorf("%v: got sampling factors %dx%d, want %dx%d", test.ratio, y.HSampFactor, y.VSampFactor, test.hs, test.vs)
+		}
+		got, err := DecodeIntoRGB(&buf, nil)
+		if err != nil {
+			t.Fatalf("%v: DecodeIntoRGB returns error: %v", test.ratio, err)
+		}
+		if got.Bounds() != b {
+			t.Fatalf("%v: got %v, want %v", test.ratio, got.Bounds(), b)
+		}
+		if d := meanDiff(got, img); d > 4*0x101 {
+			t.Errorf("%v: differs by %v", test.ratio, d)
+		}
+	}
+
+	img := image.NewYCbCr(image.Rect(0, 0, 16, 16), image.YCbCrSubsampleRatio420)
+	img.SubsampleRatio = image.YCbCrSubsampleRatio(100)
+	if err := Encode(ioutil.Discard, img, nil); err == nil {
+		t.Errorf("Encode with an unknown subsample ratio returns no error")
+	}
+}
+
 // See: https://github.com/pixiv/go-libjpeg/issues/36
 func TestDecodeAndEncodeRGBADisableFancyUpsampling(t *testing.T) {
 	src := image.NewRGBA(image.Rect(0, 0, 3000, 2000))
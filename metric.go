@@ -0,0 +1,137 @@
+package jpeg
+
+import (
+	"errors"
+	"image"
+	"math"
+)
+
+// SSIM returns the mean structural similarity of the luma of a and b, which
+// is 1 for identical images and lower the more they differ. It is computed on
+// 8x8 windows moved by 4 pixels, with the constants of Wang et al.
+//
+// Translucent pixels are composited onto white, like Encode does by default.
+func SSIM(a, b image.Image) (float64, error) {
+	return ssim(a, b, newBackground(nil))
+}
+
+func ssim(a, b image.Image, bg background) (float64, error) {
+	la, lb, w, h, err := lumaPlanes(a, b, bg)
+	if err != nil {
+		return 0, err
+	}
+	const (
+		c1 = (0.01 * 255) * (0.01 * 255)
+		c2 = (0.03 * 255) * (0.03 * 255)
+	)
+	size, step := 8, 4
+	if w < size || h < size {
+		// The whole image is a single window.
+		size = w
+		if h < size {
+			size = h
+		}
+	}
+	var sum float64
+	var n int
+	for y := 0; y+size <= h; y += step {
+		for x := 0; x+size <= w; x += step {
+			var sa, sb, saa, sbb, sab float64
+			for j := y; j < y+size; j++ {
+				for i := x; i < x+size; i++ {
+					pa, pb := float64(la[j*w+i]), float64(lb[j*w+i])
+					sa += pa
+					sb += pb
+					saa += pa * pa
+					sbb += pb * pb
+					sab += pa * pb
+				}
+			}
+			count := float64(size * size)
+			ma, mb := sa/count, sb/count
+			va, vb := saa/count-ma*ma, sbb/count-mb*mb
+			cov := sab/count - ma*mb
+			sum += (2*ma*mb + c1) * (2*cov + c2) / ((ma*ma + mb*mb + c1) * (va + vb + c2))
+			n++
+		}
+	}
+	return sum / float64(n), nil
+}
+
+// PSNR returns the peak signal-to-noise ratio of the luma of a and b in
+// decibels, which is +Inf for identical images.
+//
+// Translucent pixels are composited onto white, like Encode does by default.
+func PSNR(a, b image.Image) (float64, error) {
+	return psnr(a, b, newBackground(nil))
+}
+
+func psnr(a, b image.Image, bg background) (float64, error) {
+	la, lb, _, _, err := lumaPlanes(a, b, bg)
+	if err != nil {
+		return 0, err
+	}
+	var sum float64
+	for i := range la {
+		d := float64(la[i]) - float64(lb[i])
+		sum += d * d
+	}
+	if sum == 0 {
+		return math.Inf(1), nil
+	}
+	mse := sum / float64(len(la))
+	return 10 * math.Log10(255*255/mse), nil
+}
+
+// lumaPlanes returns the luma of a and b, which must be of the same size.
+func lumaPlanes(a, b image.Image, bg background) (la, lb []uint8, w, h int, err error) {
+	if a.Bounds().Size() != b.Bounds().Size() {
+		return nil, nil, 0, 0, errors.New("images differ in size")
+	}
+	w, h = a.Bounds().Dx(), a.Bounds().Dy()
+	if w <= 0 || h <= 0 {
+		return nil, nil, 0, 0, errors.New("empty image")
+	}
+	return luma(a, bg), luma(b, bg), w, h, nil
+}
+
+// luma returns the luma plane of img, as JPEG computes it from RGB after
+// compositing onto bg.
+func luma(img image.Image, bg background) []uint8 {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	pix := make([]uint8, w*h)
+	switch img := img.(type) {
+	case *image.YCbCr:
+		for y := 0; y < h; y++ {
+			copy(pix[y*w:(y+1)*w], img.Y[img.YOffset(b.Min.X, b.Min.Y+y):])
+		}
+	case *image.Gray:
+		for y := 0; y < h; y++ {
+			copy(pix[y*w:(y+1)*w], img.Pix[img.PixOffset(b.Min.X, b.Min.Y+y):])
+		}
+	case *RGB:
+		for y := 0; y < h; y++ {
+			row := img.Pix[img.PixOffset(b.Min.X, b.Min.Y+y):]
+			for x := 0; x < w; x++ {
+				pix[y*w+x] = rgbLuma(uint32(row[x*3]), uint32(row[x*3+1]), uint32(row[x*3+2]))
+			}
+		}
+	default:
+		var rgb [3]uint8
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				r, g, bl, a := img.At(b.Min.X+x, b.Min.Y+y).RGBA()
+				bg.composite(rgb[:], r, g, bl, a)
+				pix[y*w+x] = rgbLuma(uint32(rgb[0]), uint32(rgb[1]), uint32(rgb[2]))
+			}
+		}
+	}
+	return pix
+}
+
+// rgbLuma returns the luma of an 8-bit RGB color with the rounding of
+// color.RGBToYCbCr.
+func rgbLuma(r, g, b uint32) uint8 {
+	return uint8((19595*r + 38470*g + 7471*b + 1<<15) >> 16)
+}
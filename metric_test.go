@@ -0,0 +1,76 @@
+package jpeg
+
+import (
+	"image"
+	"io/ioutil"
+	"math"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	data, err := ioutil.ReadFile("images/kinkaku.jpg")
+	if err != nil {
+		t.Fatalf("reading file: %v", err)
+	}
+	img, err := DecodeBytes(data, nil)
+	if err != nil {
+		t.Fatalf("Decode returns error: %v", err)
+	}
+	rgb, err := DecodeBytesIntoRGB(data, nil)
+	if err != nil {
+		t.Fatalf("DecodeIntoRGB returns error: %v", err)
+	}
+
+	if s, err := SSIM(img, img); err != nil || s != 1 {
+		t.Errorf("SSIM of an image with itself: got %v, %v", s, err)
+	}
+	if p, err := PSNR(img, img); err != nil || !math.IsInf(p, 1) {
+		t.Errorf("PSNR of an image with itself: got %v, %v", p, err)
+	}
+	// The luma computed from RGB is close to the decoded luma.
+	if s, err := SSIM(img, rgb); err != nil || s < 0.99 {
+		t.Errorf("SSIM of YCbCr and RGB decodings: got %v, %v", s, err)
+	}
+
+	// Coarser quantization lowers both metrics.
+	var prevSSIM, prevPSNR = 1.0, math.Inf(1)
+	for _, quality := range []int{90, 50, 10} {
+		encoded, err := EncodeToBytes(img, &EncoderOptions{Quality: quality})
+		if err != nil {
+			t.Fatalf("EncodeToBytes returns error: %v", err)
+		}
+		decoded, err := DecodeBytes(encoded, nil)
+		if err != nil {
+			t.Fatalf("Decode returns error: %v", err)
+		}
+		s, err := SSIM(img, decoded)
+		if err != nil {
+			t.Fatalf("SSIM returns error: %v", err)
+		}
+		p, err := PSNR(img, decoded)
+		if err != nil {
+			t.Fatalf("PSNR returns error: %v", err)
+		}
+		if s >= prevSSIM || p >= prevPSNR || s <= 0 || p <= 0 {
+			t.Errorf("quality %d: got SSIM %v and PSNR %v after %v and %v", quality, s, p, prevSSIM, prevPSNR)
+		}
+		prevSSIM, prevPSNR = s, p
+	}
+
+	// Images smaller than a window are a single window.
+	small := image.NewGray(image.Rect(0, 0, 5, 3))
+	if s, err := SSIM(small, small); err != nil || s != 1 {
+		t.Errorf("SSIM of a small image: got %v, %v", s, err)
+	}
+	// Transparent pixels are white, as Encode writes them by default.
+	white := image.NewGray(small.Bounds())
+	for i := range white.Pix {
+		white.Pix[i] = 0xff
+	}
+	if p, err := PSNR(image.NewNRGBA(small.Bounds()), white); err != nil || !math.IsInf(p, 1) {
+		t.Errorf("PSNR of a transparent image and white: got %v, %v", p, err)
+	}
+	if _, err := SSIM(img, small); err == nil {
+		t.Errorf("SSIM of images of different sizes returns no error")
+	}
+}
@@ -0,0 +1,47 @@
+package jpeg
+
+import (
+	"sync"
+)
+
+var decoderPool = sync.Pool{
+	New: func() interface{} {
+		return NewDecoder()
+	},
+}
+
+var encoderPool = sync.Pool{
+	New: func() interface{} {
+		return NewEncoder()
+	},
+}
+
+// GetDecoder returns a Decoder from the package-level pool.
+// The Decoder should be given back with PutDecoder when it is no longer used.
+func GetDecoder() *Decoder {
+	return decoderPool.Get().(*Decoder)
+}
+
+// PutDecoder gives d back to the package-level pool.
+// d must not be used after PutDecoder.
+func PutDecoder(d *Decoder) {
+	if d == nil {
+		return
+	}
+	decoderPool.Put(d)
+}
+
+// GetEncoder returns an Encoder from the package-level pool.
+// The Encoder should be given back with PutEncoder when it is no longer used.
+func GetEncoder() *Encoder {
+	return encoderPool.Get().(*Encoder)
+}
+
+// PutEncoder gives e back to the package-level pool.
+// e must not be used after PutEncoder.
+func PutEncoder(e *Encoder) {
+	if e == nil {
+		return
+	}
+	encoderPool.Put(e)
+}
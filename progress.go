@@ -0,0 +1,110 @@
+package jpeg
+
+/*
+#include <stdlib.h>
+#include <stdint.h>
+#include <stdio.h>
+#include "jpeglib.h"
+#include "jerror.h"
+#include "jpeg.h"
+
+// exported from golang
+void progressReport(uintptr_t, int, int, long, long);
+
+static void progress_monitor(j_common_ptr cinfo) {
+	struct go_progress_mgr *p = (struct go_progress_mgr *)cinfo->progress;
+	if (p->handle != 0) {
+		progressReport(p->handle, p->pub.completed_passes, p->pub.total_passes, p->pub.pass_counter, p->pub.pass_limit);
+	}
+	// Stop reading pathological progressive images. This must be done here
+	// in C since longjmp must not cross the Go callback above.
+	if (p->max_scans > 0 && cinfo->is_decompressor &&
+	    ((j_decompress_ptr)cinfo)->input_scan_number > p->max_scans) {
+		p->scan_limit_hit = 1;
+		ERREXIT(cinfo, JERR_BAD_PROGRESSION);
+	}
+}
+
+static struct go_progress_mgr *calloc_go_progress_mgr(void) {
+	return calloc(sizeof(struct go_progress_mgr), 1);
+}
+
+static void free_go_progress_mgr(struct go_progress_mgr *p) {
+	free(p);
+}
+
+static void set_progress(j_common_ptr cinfo, struct go_progress_mgr *p) {
+	if (p != NULL) {
+		p->pub.progress_monitor = progress_monitor;
+	}
+	cinfo->progress = (struct jpeg_progress_mgr *)p;
+}
+
+*/
+import "C"
+
+import (
+	"errors"
+	"runtime/cgo"
+	"unsafe"
+)
+
+// ProgressFunc receives progress reports from libjpeg.
+//
+// pass is the number of completed passes out of totalPasses, and done is the
+// progress of the current pass out of total. A progressive image or an
+// optimized encoding takes several passes, and totalPasses may grow while
+// decoding a progressive image since the number of scans is not known in
+// advance.
+//
+// The function is called from inside libjpeg and must not panic.
+type ProgressFunc func(pass, totalPasses int, done, total int64)
+
+//export progressReport
+func progressReport(handle C.uintptr_t, pass, totalPasses C.int, done, total C.long) {
+	fn := cgo.Handle(handle).Value().(ProgressFunc)
+	fn(int(pass), int(totalPasses), int64(done), int64(total))
+}
+
+// attachProgress installs a progress monitor on cinfo which reports to fn and
+// stops decoding after maxScans scans, allocating *p on first use. It does
+// nothing if neither is set.
+func attachProgress(cinfo unsafe.Pointer, p **C.struct_go_progress_mgr, fn ProgressFunc, maxScans int) error {
+	if fn == nil && maxScans <= 0 {
+		return nil
+	}
+	if *p == nil {
+		*p = C.calloc_go_progress_mgr()
+		if *p == nil {
+			return errors.New("failed to allocate C.struct_go_progress_mgr")
+		}
+	}
+	if fn != nil {
+		(*p).handle = C.uintptr_t(cgo.NewHandle(fn))
+	}
+	(*p).max_scans = C.int(maxScans)
+	(*p).scan_limit_hit = 0
+	C.set_progress(C.j_common_ptr(cinfo), *p)
+	return nil
+}
+
+// detachProgress removes the progress monitor of cinfo. p is kept so that it
+// can be attached again.
+func detachProgress(cinfo unsafe.Pointer, p *C.struct_go_progress_mgr) {
+	if p == nil {
+		return
+	}
+	if p.handle != 0 {
+		cgo.Handle(p.handle).Delete()
+		p.handle = 0
+	}
+	p.max_scans = 0
+	p.scan_limit_hit = 0
+	C.set_progress(C.j_common_ptr(cinfo), nil)
+}
+
+func releaseProgress(p *C.struct_go_progress_mgr) {
+	if p != nil {
+		C.free_go_progress_mgr(p)
+	}
+}
@@ -0,0 +1,77 @@
+package jpeg
+
+// rawPlane is a plane of samples exchanged with libjpeg's raw data interface,
+// which works on whole blocks: it touches every column up to the padded width
+// of the component and every row up to the end of the iMCU row, beyond the
+// image itself.
+//
+// Rows which cannot be handed to libjpeg directly, because the plane has no
+// such padding or the last iMCU row is partial, go through a scratch buffer
+// instead. When encoding, the edges of the scratch buffer are replicated from
+// the image so that the padding does not cost bits; when decoding, the
+// samples of the image are copied back from it.
+type rawPlane struct {
+	pix           []uint8 // pix starts at the origin of the image.
+	stride        int
+	width, height int // width and height are the samples of the image.
+	paddedWidth   int // paddedWidth is the number of columns libjpeg touches.
+
+	scratch []uint8
+}
+
+// fits reports whether n rows from row y can be handed to libjpeg directly.
+func (p *rawPlane) fits(y, n int) bool {
+	return p.stride >= p.paddedWidth && y+n <= p.height && (y+n-1)*p.stride+p.paddedWidth <= len(p.pix)
+}
+
+// scratchRows returns a scratch buffer of n rows of paddedWidth samples.
+func (p *rawPlane) scratchRows(n int) []uint8 {
+	if size := n * p.paddedWidth; cap(p.scratch) < size {
+		p.scratch = make([]uint8, size)
+	} else {
+		p.scratch = p.scratch[:size]
+	}
+	return p.scratch
+}
+
+// input returns the n rows from row y for libjpeg to read, and their stride.
+func (p *rawPlane) input(y, n int) ([]uint8, int) {
+	if p.fits(y, n) {
+		return p.pix[y*p.stride:], p.stride
+	}
+	buf := p.scratchRows(n)
+	for r := 0; r < n; r++ {
+		sy := y + r
+		if sy >= p.height {
+			sy = p.height - 1
+		}
+		row := buf[r*p.paddedWidth : (r+1)*p.paddedWidth]
+		copy(row[:p.width], p.pix[sy*p.stride:])
+		for x := p.width; x < p.paddedWidth; x++ {
+			row[x] = row[p.width-1]
+		}
+	}
+	return buf, p.paddedWidth
+}
+
+// output returns room for libjpeg to write the n rows from row y, and its
+// stride. If the room is a scratch buffer, flush must be called once the
+// rows are written.
+func (p *rawPlane) output(y, n int) ([]uint8, int) {
+	if p.fits(y, n) {
+		p.scratch = p.scratch[:0]
+		return p.pix[y*p.stride:], p.stride
+	}
+	return p.scratchRows(n), p.paddedWidth
+}
+
+// flush copies the rows of the image written by libjpeg into the scratch
+// buffer returned by output back into the plane.
+func (p *rawPlane) flush(y, n int) {
+	if len(p.scratch) == 0 {
+		return
+	}
+	for r := 0; r < n && y+r < p.height; r++ {
+		copy(p.pix[(y+r)*p.stride:(y+r)*p.stride+p.width], p.scratch[r*p.paddedWidth:])
+	}
+}
@@ -0,0 +1,106 @@
+package jpeg
+
+import (
+	"bytes"
+	"image"
+	"testing"
+)
+
+func TestRawPlane(t *testing.T) {
+	// A 5x5 plane without any padding, handed over in rows of 4 blocks of 8
+	// columns like a 4:2:0 luma plane of a 5x5 image.
+	pix := make([]uint8, 25)
+	for i := range pix {
+		pix[i] = uint8(i)
+	}
+	p := rawPlane{pix: pix, stride: 5, width: 5, height: 5, paddedWidth: 8}
+	buf, stride := p.input(0, 8)
+	if stride != 8 || len(buf) < 7*stride+8 {
+		t.Fatalf("got %d bytes with stride %d", len(buf), stride)
+	}
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			sx, sy := x, y
+			if sx > 4 {
+				sx = 4
+			}
+			if sy > 4 {
+				sy = 4
+			}
+			if got, want := buf[y*stride+x], pix[sy*5+sx]; got != want {
+				t.Fatalf("(%d, %d) is %d, want %d", x, y, got, want)
+			}
+		}
+	}
+
+	dst := make([]uint8, 25)
+	p = rawPlane{pix: dst, stride: 5, width: 5, height: 5, paddedWidth: 8}
+	buf, stride = p.output(0, 8)
+	for i := range buf {
+		buf[i] = uint8(i/stride*5 + i%stride)
+	}
+	p.flush(0, 8)
+	if !bytes.Equal(dst, pix) {
+		t.Errorf("got %v, want %v", dst, pix)
+	}
+
+	// A padded plane is used directly.
+	pix = make([]uint8, 16*16)
+	p = rawPlane{pix: pix, stride: 16, width: 5, height: 16, paddedWidth: 8}
+	if buf, stride = p.input(0, 8); stride != 16 || &buf[0] != &pix[0] {
+		t.Errorf("padded plane is copied")
+	}
+}
+
+func TestEncodeUnpaddedPlanes(t *testing.T) {
+	// The rows right below the image are white, so that reading them as the
+	// padding of the last iMCU row would ring into its black bottom edge.
+	for _, ratio := range []image.YCbCrSubsampleRatio{image.YCbCrSubsampleRatio444, image.YCbCrSubsampleRatio420, image.YCbCrSubsampleRatio410} {
+		parent := image.NewYCbCr(image.Rect(0, 0, 37, 32), ratio)
+		for i := range parent.Cb {
+			parent.Cb[i], parent.Cr[i] = 128, 128
+		}
+		for y := 20; y < 32; y++ {
+			for x := 0; x < 37; x++ {
+				parent.Y[parent.YOffset(x, y)] = 255
+			}
+		}
+		exact := image.NewYCbCr(image.Rect(0, 0, 37, 20), ratio)
+		for i := range exact.Cb {
+			exact.Cb[i], exact.Cr[i] = 128, 128
+		}
+		for _, img := range []image.Image{parent.SubImage(image.Rect(0, 0, 37, 20)), exact} {
+			var buf bytes.Buffer
+			if err := Encode(&buf, img, &EncoderOptions{Quality: 90}); err != nil {
+				t.Fatalf("%v: Encode returns error: %v", ratio, err)
+			}
+			got, err := DecodeIntoRGB(&buf, nil)
+			if err != nil {
+				t.Fatalf("%v: DecodeIntoRGB returns error: %v", ratio, err)
+			}
+			for x := 0; x < 37; x++ {
+				if c := got.RGBAt(x, 19); c.R > 4 || c.G > 4 || c.B > 4 {
+					t.Fatalf("%v: bottom edge pixel (%d, 19) is %v", ratio, x, c)
+				}
+			}
+		}
+	}
+
+	parent := image.NewGray(image.Rect(0, 0, 37, 32))
+	for i := 20 * parent.Stride; i < len(parent.Pix); i++ {
+		parent.Pix[i] = 255
+	}
+	var buf bytes.Buffer
+	if err := Encode(&buf, parent.SubImage(image.Rect(0, 0, 37, 20)), &EncoderOptions{Quality: 90}); err != nil {
+		t.Fatalf("Encode returns error: %v", err)
+	}
+	got, err := Decode(&buf, nil)
+	if err != nil {
+		t.Fatalf("Decode returns error: %v", err)
+	}
+	for x := 0; x < 37; x++ {
+		if y := got.(*image.Gray).GrayAt(x, 19).Y; y > 4 {
+			t.Fatalf("bottom edge pixel (%d, 19) is %d", x, y)
+		}
+	}
+}
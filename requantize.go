@@ -0,0 +1,149 @@
+package jpeg
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// RequantizeOptions specifies the new quantization of a JPEG image.
+//
+// QuantTables replaces the quantization table of the same slot, and the slots
+// left nil get the tables libjpeg uses for Quality: the luminance table for
+// slot 0 and the chrominance table for the others.
+type RequantizeOptions struct {
+	Quality     int         // Quality of the default tables, 1 to 100.
+	QuantTables [4][]uint16 // QuantTables are explicit tables in natural order.
+}
+
+// Requantize reads a JPEG image from r, quantizes its DCT coefficients again
+// with the tables of options and writes the result into w. The pixels are not
+// decoded, so there is no IDCT/DCT rounding loss on top of the coarser
+// quantization.
+//
+// A quantization step finer than the one already in the image cannot restore
+// the lost precision, so the coarser of the two is kept for each coefficient.
+func Requantize(r io.Reader, w io.Writer, options *RequantizeOptions) error {
+	if options == nil {
+		options = &RequantizeOptions{Quality: 75}
+	}
+	d := new(Decoder)
+	defer d.Close()
+	c, err := d.readCoefficients(r, nil, CopyAll)
+	if err != nil {
+		return err
+	}
+	if err := requantizeCoefficients(c, options); err != nil {
+		return err
+	}
+	e := new(Encoder)
+	defer e.Close()
+	return e.writeCoefficients(w, c, &CoefficientOptions{ProgressiveMode: c.Progressive, OptimizeCoding: true})
+}
+
+// requantizeCoefficients quantizes the blocks of c with the tables of options
+// in place.
+func requantizeCoefficients(c *Coefficients, options *RequantizeOptions) error {
+	var tables [4][]uint16
+	for i, old := range c.QuantTables {
+		if old == nil {
+			continue
+		}
+		table := options.QuantTables[i]
+		if table == nil {
+			if options.Quality < 1 || options.Quality > 100 {
+				return fmt.Errorf("invalid quality: %d", options.Quality)
+			}
+			base := stdChrominanceQuantTable
+			if i == 0 {
+				base = stdLuminanceQuantTable
+			}
+			table = qualityQuantTable(base, options.Quality)
+		}
+		if len(table) != len(old) {
+			return fmt.Errorf("invalid quantization table %d", i)
+		}
+		tables[i] = make([]uint16, len(old))
+		for k, q := range table {
+			if q == 0 {
+				return fmt.Errorf("invalid quantization table %d", i)
+			}
+			tables[i][k] = q
+			if old[k] > q {
+				tables[i][k] = old[k]
+			}
+		}
+	}
+
+	for i := range c.Components {
+		comp := &c.Components[i]
+		old, table := c.QuantTables[comp.QuantTable], tables[comp.QuantTable]
+		if table == nil {
+			return errors.New("missing quantization table")
+		}
+		for b := range comp.Blocks {
+			block := &comp.Blocks[b]
+			for k, v := range block {
+				block[k] = requantize(v, old[k], table[k])
+			}
+		}
+	}
+	c.QuantTables = tables
+	return nil
+}
+
+// requantize returns the coefficient v quantized with oldQ, quantized again
+// with newQ and rounded to the nearest step.
+func requantize(v int16, oldQ, newQ uint16) int16 {
+	x := int32(v) * int32(oldQ)
+	q := int32(newQ)
+	if x < 0 {
+		return int16(-((-x + q/2) / q))
+	}
+	return int16((x + q/2) / q)
+}
+
+// stdLuminanceQuantTable and stdChrominanceQuantTable are the sample tables of
+// ITU-T T.81 Annex K in natural order, which libjpeg scales by quality.
+var (
+	stdLuminanceQuantTable = []uint16{
+		16, 11, 10, 16, 24, 40, 51, 61,
+		12, 12, 14, 19, 26, 58, 60, 55,
+		14, 13, 16, 24, 40, 57, 69, 56,
+		14, 17, 22, 29, 51, 87, 80, 62,
+		18, 22, 37, 56, 68, 109, 103, 77,
+		24, 35, 55, 64, 81, 104, 113, 92,
+		49, 64, 78, 87, 103, 121, 120, 101,
+		72, 92, 95, 98, 112, 100, 103, 99,
+	}
+	stdChrominanceQuantTable = []uint16{
+		17, 18, 24, 47, 99, 99, 99, 99,
+		18, 21, 26, 66, 99, 99, 99, 99,
+		24, 26, 56, 99, 99, 99, 99, 99,
+		47, 66, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+	}
+)
+
+// qualityQuantTable scales base for quality like jpeg_set_quality with
+// force_baseline set.
+func qualityQuantTable(base []uint16, quality int) []uint16 {
+	scale := 200 - quality*2
+	if quality < 50 {
+		scale = 5000 / quality
+	}
+	table := make([]uint16, len(base))
+	for i, b := range base {
+		v := (int(b)*scale + 50) / 100
+		if v < 1 {
+			v = 1
+		} else if v > 255 {
+			v = 255
+		}
+		table[i] = uint16(v)
+	}
+	return table
+}
@@ -0,0 +1,132 @@
+package jpeg
+
+import (
+	"bytes"
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+func TestQualityQuantTable(t *testing.T) {
+	data, err := ioutil.ReadFile("images/kinkaku.jpg")
+	if err != nil {
+		t.Fatalf("reading file: %v", err)
+	}
+	src, err := DecodeBytesIntoRGB(data, nil)
+	if err != nil {
+		t.Fatalf("DecodeIntoRGB returns error: %v", err)
+	}
+	for _, quality := range []int{1, 10, 50, 75, 100} {
+		var buf bytes.Buffer
+		if err := Encode(&buf, src, &EncoderOptions{Quality: quality}); err != nil {
+			t.Fatalf("Encode returns error: %v", err)
+		}
+		c, err := ReadCoefficients(&buf)
+		if err != nil {
+			t.Fatalf("ReadCoefficients returns error: %v", err)
+		}
+		if got, want := c.QuantTables[0], qualityQuantTable(stdLuminanceQuantTable, quality); !reflect.DeepEqual(got, want) {
+			t.Errorf("quality %d: luminance table is %v, want %v", quality, got, want)
+		}
+		if got, want := c.QuantTables[1], qualityQuantTable(stdChrominanceQuantTable, quality); !reflect.DeepEqual(got, want) {
+			t.Errorf("quality %d: chrominance table is %v, want %v", quality, got, want)
+		}
+	}
+}
+
+func TestRequantize(t *testing.T) {
+	for _, file := range []string{"images/kinkaku.jpg", "images/testdata/video-001.q50.420.progressive.jpeg", "images/testdata/video-005.gray.jpeg"} {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatalf("reading file: %v", err)
+		}
+		src, err := DecodeBytesIntoRGB(data, nil)
+		if err != nil {
+			t.Fatalf("%s: DecodeIntoRGB returns error: %v", file, err)
+		}
+		orig, err := ReadCoefficients(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("%s: ReadCoefficients returns error: %v", file, err)
+		}
+
+		var out bytes.Buffer
+		if err := Requantize(bytes.NewReader(data), &out, &RequantizeOptions{Quality: 20}); err != nil {
+			t.Fatalf("%s: Requantize returns error: %v", file, err)
+		}
+		if out.Len() >= len(data) {
+			t.Errorf("%s: requantized image is %d bytes, original %d", file, out.Len(), len(data))
+		}
+		c, err := ReadCoefficients(bytes.NewReader(out.Bytes()))
+		if err != nil {
+			t.Fatalf("%s: ReadCoefficients returns error: %v", file, err)
+		}
+		if c.Progressive != orig.Progressive {
+			t.Errorf("%s: progressive changed to %v", file, c.Progressive)
+		}
+		img, err := DecodeBytesIntoRGB(out.Bytes(), nil)
+		if err != nil {
+			t.Fatalf("%s: decoding requantized image returns error: %v", file, err)
+		}
+		if d := meanDiff(src, img); d > 12*0x101 {
+			t.Errorf("%s: requantized image differs by %v", file, d)
+		}
+
+		// Finer tables keep the existing ones, so nothing changes.
+		out.Reset()
+		if err := Requantize(bytes.NewReader(data), &out, &RequantizeOptions{Quality: 100}); err != nil {
+			t.Fatalf("%s: Requantize returns error: %v", file, err)
+		}
+		c, err = ReadCoefficients(&out)
+		if err != nil {
+			t.Fatalf("%s: ReadCoefficients returns error: %v", file, err)
+		}
+		if !reflect.DeepEqual(c.Components, orig.Components) || !reflect.DeepEqual(c.QuantTables, orig.QuantTables) {
+			t.Errorf("%s: quality 100 changed the coefficients", file)
+		}
+	}
+
+	data, err := ioutil.ReadFile("images/kinkaku.jpg")
+	if err != nil {
+		t.Fatalf("reading file: %v", err)
+	}
+	table := make([]uint16, 64)
+	for i := range table {
+		table[i] = 64
+	}
+	var out bytes.Buffer
+	if err := Requantize(bytes.NewReader(data), &out, &RequantizeOptions{Quality: 90, QuantTables: [4][]uint16{table}}); err != nil {
+		t.Fatalf("Requantize returns error: %v", err)
+	}
+	c, err := ReadCoefficients(&out)
+	if err != nil {
+		t.Fatalf("ReadCoefficients returns error: %v", err)
+	}
+	for i, q := range c.QuantTables[0] {
+		if q < 64 {
+			t.Fatalf("luminance table entry %d is %d, want at least 64", i, q)
+		}
+	}
+	if err := Requantize(bytes.NewReader(data), ioutil.Discard, &RequantizeOptions{}); err == nil {
+		t.Errorf("Requantize with quality 0 returns no error")
+	}
+}
+
+func TestRequantizeRounding(t *testing.T) {
+	tests := []struct {
+		v          int16
+		oldQ, newQ uint16
+		want       int16
+	}{
+		{10, 2, 4, 5},
+		{3, 2, 4, 2},
+		{-3, 2, 4, -2},
+		{1, 5, 20, 0},
+		{-2, 5, 20, -1},
+		{7, 1, 1, 7},
+	}
+	for _, test := range tests {
+		if got := requantize(test.v, test.oldQ, test.newQ); got != test.want {
+			t.Errorf("requantize(%d, %d, %d) = %d, want %d", test.v, test.oldQ, test.newQ, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package jpeg
+
+import (
+	"math"
+)
+
+// Filter is a resampling filter used by Thumbnail.
+type Filter int
+
+const (
+	// Lanczos3 is a sharp windowed sinc filter with a support of 3 pixels.
+	Lanczos3 Filter = iota
+	// CatmullRom is a cubic filter, slightly softer than Lanczos3.
+	CatmullRom
+	// Box averages the source pixels covered by each destination pixel.
+	Box
+)
+
+// support returns the radius of the filter in source pixels at a scale of 1.
+func (f Filter) support() float64 {
+	switch f {
+	case CatmullRom:
+		return 2
+	case Box:
+		return 0.5
+	default:
+		return 3
+	}
+}
+
+func (f Filter) at(x float64) float64 {
+	x = math.Abs(x)
+	switch f {
+	case CatmullRom:
+		switch {
+		case x < 1:
+			return (1.5*x-2.5)*x*x + 1
+		case x < 2:
+			return ((-0.5*x+2.5)*x-4)*x + 2
+		}
+		return 0
+	case Box:
+		if x <= 0.5 {
+			return 1
+		}
+		return 0
+	default:
+		switch {
+		case x == 0:
+			return 1
+		case x < 3:
+			px := math.Pi * x
+			return 3 * math.Sin(px) * math.Sin(px/3) / (px * px)
+		}
+		return 0
+	}
+}
+
+// taps holds the source indices and weights of every destination sample
+// along one axis.
+type taps struct {
+	start   []int     // start is the first source index of each destination sample.
+	n       int       // n is the number of weights per destination sample.
+	weights []float32 // weights holds n weights per destination sample.
+}
+
+// makeTaps computes the taps to resample the source interval [offset,
+// offset+length) of an axis into dstSize samples. Taps may fall outside of
+// the axis; they are clamped to its edges by sampleAt.
+func makeTaps(f Filter, offset, length float64, dstSize int) *taps {
+	scale := length / float64(dstSize)
+	// Widen the filter when shrinking so that it averages over every source
+	// sample instead of skipping some.
+	filterScale := math.Max(scale, 1)
+	support := f.support() * filterScale
+
+	t := &taps{start: make([]int, dstSize)}
+	t.n = int(math.Ceil(support))*2 + 1
+	t.weights = make([]float32, dstSize*t.n)
+	for i := 0; i < dstSize; i++ {
+		center := offset + (float64(i)+0.5)*scale
+		start := int(math.Floor(center - support + 0.5))
+		t.start[i] = start
+		w := t.weights[i*t.n : (i+1)*t.n]
+		var sum float64
+		for j := range w {
+			v := f.at((float64(start+j) + 0.5 - center) / filterScale)
+			w[j] = float32(v)
+			sum += v
+		}
+		if sum == 0 {
+			// The box filter may miss every sample when enlarging.
+			nearest := int(center) - start
+			if nearest < 0 {
+				nearest = 0
+			}
+			if nearest >= t.n {
+				nearest = t.n - 1
+			}
+			w[nearest], sum = 1, 1
+		}
+		for j := range w {
+			w[j] = float32(float64(w[j]) / sum)
+		}
+	}
+	return t
+}
+
+// sampleAt returns the index of tap j of a sample starting at start, clamped
+// to an axis of size size.
+func sampleAt(start, j, size int) int {
+	x := start + j
+	if x < 0 {
+		return 0
+	}
+	if x >= size {
+		return size - 1
+	}
+	return x
+}
+
+func clampUint8(v float32) uint8 {
+	switch {
+	case v <= 0:
+		return 0
+	case v >= 255:
+		return 255
+	}
+	return uint8(v + 0.5)
+}
+
+// plane is a rectangular area of 8-bit samples with channels interleaved
+// samples per pixel.
+type plane struct {
+	pix           []uint8
+	stride        int
+	width, height int
+	channels      int
+}
+
+// resample resizes the area (x, y, w, h) of src into dst with the filter f,
+// one axis at a time.
+func resample(dst, src plane, x, y, w, h float64, f Filter) {
+	ch := src.channels
+	xt := makeTaps(f, x, w, dst.width)
+	yt := makeTaps(f, y, h, dst.height)
+
+	// Only the source rows reached by the vertical taps need to be
+	// resampled horizontally.
+	first := yt.start[0]
+	last := yt.start[dst.height-1] + yt.n
+	if first < 0 {
+		first = 0
+	}
+	if last > src.height {
+		last = src.height
+	}
+	tmpStride := dst.width * ch
+	tmp := make([]float32, (last-first)*tmpStride)
+	for sy := first; sy < last; sy++ {
+		row := src.pix[sy*src.stride:]
+		out := tmp[(sy-first)*tmpStride:]
+		for dx := 0; dx < dst.width; dx++ {
+			start, w := xt.start[dx], xt.weights[dx*xt.n:(dx+1)*xt.n]
+			for c := 0; c < ch; c++ {
+				var v float32
+				for j, weight := range w {
+					v += weight * float32(row[sampleAt(start, j, src.width)*ch+c])
+				}
+				out[dx*ch+c] = v
+			}
+		}
+	}
+
+	rows := last - first
+	for dy := 0; dy < dst.height; dy++ {
+		start, w := yt.start[dy], yt.weights[dy*yt.n:(dy+1)*yt.n]
+		out := dst.pix[dy*dst.stride:]
+		for i := 0; i < tmpStride; i++ {
+			var v float32
+			for j, weight := range w {
+				v += weight * tmp[sampleAt(start-first, j, rows)*tmpStride+i]
+			}
+			out[i] = clampUint8(v)
+		}
+	}
+}
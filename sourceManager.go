@@ -10,9 +10,17 @@ package jpeg
 /*
 #include <stdlib.h>
 #include <stdio.h>
+#include <stdint.h>
 #include <string.h>
 #include <jpeglib.h>
 
+// go_source_mgr extends jpeg_source_mgr with a cgo.Handle of the Go side
+// sourceManager, so that the callbacks can find it without a global lookup.
+struct go_source_mgr {
+	struct jpeg_source_mgr pub;
+	uintptr_t handle;
+};
+
 // exported from golang
 void sourceInit(struct jpeg_decompress_struct*);
 void sourceSkip(struct jpeg_decompress_struct*, long);
@@ -25,56 +33,73 @@ static void* _get_jpeg_resync_to_restart() {
 	return jpeg_resync_to_restart;
 }
 
-static struct jpeg_source_mgr *calloc_jpeg_source_mgr(void) {
-	return calloc(sizeof(struct jpeg_source_mgr), 1);
+static struct go_source_mgr *calloc_go_source_mgr(void) {
+	return calloc(sizeof(struct go_source_mgr), 1);
 }
 
-static void free_jpeg_source_mgr(struct jpeg_source_mgr *p) {
+static void free_go_source_mgr(struct go_source_mgr *p) {
 	free(p);
 }
 
+static uintptr_t source_handle(struct jpeg_decompress_struct *dinfo) {
+	return ((struct go_source_mgr *)dinfo->src)->handle;
+}
+
 */
 import "C"
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"io"
 	"reflect"
-	"sync"
+	"runtime"
+	"runtime/cgo"
+	"sync/atomic"
 	"unsafe"
 )
 
-func makePseudoSlice(ptr unsafe.Pointer) []byte {
+func makePseudoSlice(ptr unsafe.Pointer, size int) []byte {
 	var buffer []byte
 	slice := (*reflect.SliceHeader)(unsafe.Pointer(&buffer))
-	slice.Cap = readBufferSize
-	slice.Len = readBufferSize
+	slice.Cap = size
+	slice.Len = size
 	slice.Data = uintptr(ptr)
 	return buffer
 }
 
-const readBufferSize = 16384
-
-var sourceManagerMapMutex sync.RWMutex
-var sourceManagerMap = make(map[uintptr]*sourceManager)
+var workingSourceManagers int64
 
 // SourceManagerMapLen returns the number of globally working sourceManagers for debug.
 func SourceManagerMapLen() int {
-	return len(sourceManagerMap)
+	return int(atomic.LoadInt64(&workingSourceManagers))
 }
 
 type sourceManager struct {
+	ext         *C.struct_go_source_mgr
 	pub         *C.struct_jpeg_source_mgr
 	buffer      unsafe.Pointer
+	bufferSize  int
 	src         io.Reader
+	ctx         context.Context
 	startOfFile bool
 	currentSize int
+
+	// window is the start of the data currently handed to libjpeg. It is
+	// buffer when reading from src, or the pinned input when decoding from
+	// memory.
+	window unsafe.Pointer
+
+	// In-memory input, see attachSourceManager.
+	mem       []byte
+	memStart  int64
+	memPinner runtime.Pinner
+	memEOF    bool
 }
 
 func getSourceManager(dinfo *C.struct_jpeg_decompress_struct) (ret *sourceManager) {
-	sourceManagerMapMutex.RLock()
-	defer sourceManagerMapMutex.RUnlock()
-	return sourceManagerMap[uintptr(unsafe.Pointer(dinfo.src))]
+	return cgo.Handle(C.source_handle(dinfo)).Value().(*sourceManager)
 }
 
 //export sourceInit
@@ -96,7 +121,7 @@ func sourceSkip(dinfo *C.struct_jpeg_decompress_struct, bytes C.long) {
 	}
 	mgr.pub.bytes_in_buffer -= C.size_t(bytes)
 	if mgr.pub.bytes_in_buffer != 0 {
-		next := unsafe.Pointer(uintptr(mgr.buffer) + uintptr(mgr.currentSize-int(mgr.pub.bytes_in_buffer)))
+		next := unsafe.Pointer(uintptr(mgr.window) + uintptr(mgr.currentSize-int(mgr.pub.bytes_in_buffer)))
 		mgr.pub.next_input_byte = (*C.JOCTET)(next)
 	}
 }
@@ -109,10 +134,31 @@ func sourceTerm(dinfo *C.struct_jpeg_decompress_struct) {
 //export sourceFill
 func sourceFill(dinfo *C.struct_jpeg_decompress_struct) C.boolean {
 	mgr := getSourceManager(dinfo)
-	buffer := makePseudoSlice(mgr.buffer)
+	buffer := makePseudoSlice(mgr.buffer, mgr.bufferSize)
+	if mgr.mem != nil {
+		// The whole input has already been consumed.
+		if len(mgr.mem) == 0 {
+			return C.FALSE
+		}
+		mgr.memEOF = true
+		mgr.window = mgr.buffer
+		mgr.currentSize = copy(buffer, []byte{0xff, C.JPEG_EOI})
+		mgr.pub.bytes_in_buffer = C.size_t(mgr.currentSize)
+		mgr.pub.next_input_byte = (*C.JOCTET)(mgr.buffer)
+		return C.TRUE
+	}
+	if mgr.ctx != nil && mgr.ctx.Err() != nil {
+		// Stop reading; the decoding loops report the cancellation.
+		mgr.window = mgr.buffer
+		mgr.currentSize = copy(buffer, []byte{0xff, C.JPEG_EOI})
+		mgr.pub.bytes_in_buffer = C.size_t(mgr.currentSize)
+		mgr.pub.next_input_byte = (*C.JOCTET)(mgr.buffer)
+		return C.TRUE
+	}
 	bytes, err := mgr.src.Read(buffer)
 	mgr.pub.bytes_in_buffer = C.size_t(bytes)
 	mgr.currentSize = bytes
+	mgr.window = mgr.buffer
 	mgr.pub.next_input_byte = (*C.JOCTET)(mgr.buffer)
 	if err == io.EOF {
 		if bytes == 0 {
@@ -130,17 +176,18 @@ func sourceFill(dinfo *C.struct_jpeg_decompress_struct) C.boolean {
 	return C.TRUE
 }
 
-func makeSourceManager(src io.Reader, dinfo *C.struct_jpeg_decompress_struct) (mgr *sourceManager, err error) {
+func makeSourceManager(dinfo *C.struct_jpeg_decompress_struct) (mgr *sourceManager, err error) {
 	mgr = new(sourceManager)
-	mgr.src = src
-	mgr.pub = C.calloc_jpeg_source_mgr()
-	if mgr.pub == nil {
-		err = errors.New("failed to allocate C.struct_jpeg_source_mgr")
+	mgr.ext = C.calloc_go_source_mgr()
+	if mgr.ext == nil {
+		err = errors.New("failed to allocate C.struct_go_source_mgr")
 		return
 	}
-	mgr.buffer = C.calloc(readBufferSize, 1)
+	mgr.pub = &mgr.ext.pub
+	mgr.bufferSize = DefaultBufferSize
+	mgr.buffer = C.calloc(C.size_t(mgr.bufferSize), 1)
 	if mgr.buffer == nil {
-		C.free_jpeg_source_mgr(mgr.pub)
+		C.free_go_source_mgr(mgr.ext)
 		err = errors.New("failed to allocate buffer")
 		return
 	}
@@ -149,24 +196,111 @@ func makeSourceManager(src io.Reader, dinfo *C.struct_jpeg_decompress_struct) (m
 	mgr.pub.skip_input_data = (*[0]byte)(C.sourceSkip)
 	mgr.pub.resync_to_restart = (*[0]byte)(C._get_jpeg_resync_to_restart())
 	mgr.pub.term_source = (*[0]byte)(C.sourceTerm)
-	mgr.pub.bytes_in_buffer = 0
-	mgr.pub.next_input_byte = nil
 	dinfo.src = mgr.pub
+	return
+}
 
-	sourceManagerMapMutex.Lock()
-	defer sourceManagerMapMutex.Unlock()
-	sourceManagerMap[uintptr(unsafe.Pointer(mgr.pub))] = mgr
+// bytesReader is the reader of the DecodeBytes functions. Its data is known to
+// be the whole input, so it is decoded in place.
+type bytesReader struct {
+	*bytes.Reader
+	data []byte
+}
 
-	return
+func newBytesReader(data []byte) *bytesReader {
+	return &bytesReader{bytes.NewReader(data), data}
 }
 
-func releaseSourceManager(mgr *sourceManager) {
-	sourceManagerMapMutex.Lock()
-	defer sourceManagerMapMutex.Unlock()
-	var key = uintptr(unsafe.Pointer(mgr.pub))
-	if _, ok := sourceManagerMap[key]; ok {
-		delete(sourceManagerMap, key)
-		C.free_jpeg_source_mgr(mgr.pub)
-		C.free(mgr.buffer)
+// inMemory returns the unread contents of src without copying them if src is
+// a *bytes.Buffer or a *bytesReader. The returned offset is the position of
+// the data in a *bytesReader.
+//
+// Other readers, *bytes.Reader included, go through the read buffer: the
+// io.Reader and io.WriterTo contracts give no way to borrow their slice.
+func inMemory(src io.Reader) (data []byte, offset int64, ok bool) {
+	switch r := src.(type) {
+	case *bytes.Buffer:
+		return r.Bytes(), 0, true
+	case *bytesReader:
+		offset = r.Size() - int64(r.Len())
+		return r.data[offset:], offset, true
 	}
+	return nil, 0, false
+}
+
+// attachSourceManager makes mgr read from src through a buffer of size bytes
+// and hands a cgo.Handle of it to the C side so that the libjpeg callbacks can
+// find it.
+//
+// If src is already in memory, its contents are pinned and handed to libjpeg
+// directly instead of being copied through the read buffer.
+func attachSourceManager(mgr *sourceManager, src io.Reader, size int) error {
+	if size != mgr.bufferSize {
+		buffer := C.realloc(mgr.buffer, C.size_t(size))
+		if buffer == nil {
+			return errors.New("failed to allocate buffer")
+		}
+		mgr.buffer, mgr.bufferSize = buffer, size
+	}
+	mgr.src = src
+	mgr.startOfFile = false
+	mgr.currentSize = 0
+	mgr.window = mgr.buffer
+	mgr.pub.bytes_in_buffer = 0
+	mgr.pub.next_input_byte = nil
+	if data, offset, ok := inMemory(src); ok {
+		mgr.mem = data[:len(data):len(data)]
+		mgr.memStart = offset
+		mgr.memEOF = false
+		if len(data) > 0 {
+			mgr.memPinner.Pin(&data[0])
+			mgr.window = unsafe.Pointer(&data[0])
+			mgr.currentSize = len(data)
+			mgr.pub.bytes_in_buffer = C.size_t(len(data))
+			mgr.pub.next_input_byte = (*C.JOCTET)(mgr.window)
+		} else {
+			mgr.mem = []byte{}
+		}
+	}
+	mgr.ext.handle = C.uintptr_t(cgo.NewHandle(mgr))
+	atomic.AddInt64(&workingSourceManagers, 1)
+	return nil
+}
+
+// detachSourceManager deletes the handle of mgr and drops its reader. The C
+// buffers are kept so that mgr can be attached again.
+func detachSourceManager(mgr *sourceManager) {
+	if mgr.ext.handle == 0 {
+		return
+	}
+	cgo.Handle(mgr.ext.handle).Delete()
+	mgr.ext.handle = 0
+	if mgr.mem != nil {
+		// Leave the reader just after the consumed data as if it had been
+		// read through the buffer.
+		consumed := len(mgr.mem)
+		if !mgr.memEOF {
+			consumed -= int(mgr.pub.bytes_in_buffer)
+		}
+		switch r := mgr.src.(type) {
+		case *bytes.Buffer:
+			r.Next(consumed)
+		case *bytesReader:
+			r.Seek(mgr.memStart+int64(consumed), io.SeekStart)
+		}
+		mgr.memPinner.Unpin()
+		mgr.mem = nil
+	}
+	mgr.window = mgr.buffer
+	mgr.pub.bytes_in_buffer = 0
+	mgr.pub.next_input_byte = nil
+	mgr.src = nil
+	mgr.ctx = nil
+	atomic.AddInt64(&workingSourceManagers, -1)
+}
+
+func releaseSourceManager(mgr *sourceManager) {
+	detachSourceManager(mgr)
+	C.free_go_source_mgr(mgr.ext)
+	C.free(mgr.buffer)
 }
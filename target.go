@@ -0,0 +1,207 @@
+package jpeg
+
+import (
+	"errors"
+	"image"
+	"io"
+)
+
+// ErrSizeNotReached is returned by EncodeToSize when the image does not fit
+// the byte budget even at the lowest quality.
+var ErrSizeNotReached = errors.New("image does not fit the size limit")
+
+// SizeOptions specifies how EncodeToSize searches for the encoder settings.
+//
+// Chroma subsampling is not searched, as EncoderOptions has no setting for it:
+// YCbCr images keep their own ratio and RGB images get libjpeg's 4:2:0.
+type SizeOptions struct {
+	EncoderOptions      // EncoderOptions are the base settings; Quality is searched.
+	MinQuality     int  // MinQuality is the lowest quality tried (1 if 0).
+	MaxQuality     int  // MaxQuality is the highest quality tried (100 if 0).
+	TryModes       bool // If true, also try optimized and progressive coding at each quality.
+}
+
+// EncodeToSize encodes src into w with the highest quality whose output is at
+// most maxBytes long, and returns the settings it used. Quality is found by a
+// binary search, each step encoding into memory; the output of the best step
+// is kept, so the image is not encoded again at the end.
+//
+// If the output is over maxBytes even at the lowest quality, nothing is
+// written and ErrSizeNotReached is returned.
+func EncodeToSize(w io.Writer, src image.Image, maxBytes int, options *SizeOptions) (*EncoderOptions, error) {
+	if w == nil {
+		return nil, errors.New("nil writer")
+	}
+	if options == nil {
+		options = &SizeOptions{}
+	}
+	lo, hi := options.MinQuality, options.MaxQuality
+	if lo <= 0 {
+		lo = 1
+	}
+	if hi <= 0 || hi > 100 {
+		hi = 100
+	}
+	if lo > hi {
+		return nil, errors.New("invalid quality range")
+	}
+
+	modes := []EncoderOptions{options.EncoderOptions}
+	if options.TryModes {
+		optimized := options.EncoderOptions
+		optimized.OptimizeCoding = true
+		progressive := optimized
+		progressive.ProgressiveMode = true
+		modes = append(modes, optimized, progressive)
+	}
+
+	e := new(Encoder)
+	defer e.Close()
+	var best, buf []byte
+	var bestOptions *EncoderOptions
+	for lo <= hi {
+		quality := (lo + hi) / 2
+		// The smallest output among the modes decides whether the quality
+		// fits.
+		var smallest []byte
+		var smallestOptions EncoderOptions
+		for _, mode := range modes {
+			mode.Quality = quality
+			var err error
+			buf, err = e.AppendEncode(buf[:0], src, &mode)
+			if err != nil {
+				return nil, err
+			}
+			if smallest == nil || len(buf) < len(smallest) {
+				smallest, buf = buf, smallest
+				smallestOptions = mode
+			}
+		}
+		if len(smallest) <= maxBytes {
+			best, buf = smallest, best
+			bestOptions = &smallestOptions
+			lo = quality + 1
+		} else {
+			buf = smallest
+			hi = quality - 1
+		}
+	}
+	if bestOptions == nil {
+		return nil, ErrSizeNotReached
+	}
+	if _, err := w.Write(best); err != nil {
+		return nil, err
+	}
+	return bestOptions, nil
+}
+
+// ErrQualityNotReached is returned by EncodeToQuality when the image does not
+// meet the target even at the highest quality.
+var ErrQualityNotReached = errors.New("image does not reach the target metric")
+
+// MetricKind is a measure of the similarity of two images.
+type MetricKind int
+
+const (
+	// MetricSSIM is the structural similarity computed by SSIM.
+	MetricSSIM MetricKind = iota
+	// MetricPSNR is the peak signal-to-noise ratio in decibels computed by
+	// PSNR.
+	MetricPSNR
+)
+
+// Metric is a target similarity between an image and its encoding.
+type Metric struct {
+	Kind  MetricKind
+	Value float64 // Value is the lowest acceptable similarity, such as 0.95 for SSIM or 40 for PSNR.
+}
+
+// measure returns the similarity of a and b, with translucent pixels
+// composited onto bg.
+func (m Metric) measure(a, b image.Image, bg background) (float64, error) {
+	switch m.Kind {
+	case MetricSSIM:
+		return ssim(a, b, bg)
+	case MetricPSNR:
+		return psnr(a, b, bg)
+	}
+	return 0, errors.New("unknown metric")
+}
+
+// QualityOptions specifies how EncodeToQuality searches for the encoder
+// settings.
+type QualityOptions struct {
+	EncoderOptions     // EncoderOptions are the base settings; Quality is searched.
+	MinQuality     int // MinQuality is the lowest quality tried (1 if 0).
+	MaxQuality     int // MaxQuality is the highest quality tried (100 if 0).
+}
+
+// EncodeToQuality encodes src into w with the lowest quality whose decoded
+// result is at least as similar to src as target, and returns the settings it
+// used. Quality is found by a binary search, each step encoding and decoding
+// in memory; the output of the best step is kept, so the image is not encoded
+// again at the end.
+//
+// The images are compared on their luma, with translucent pixels of src
+// composited onto options.Background like the encoder does. CMYK images
+// cannot be verified since Decode does not read them back. If the target is
+// not met even at the highest quality, nothing is written and
+// ErrQualityNotReached is returned.
+func EncodeToQuality(w io.Writer, src image.Image, target Metric, options *QualityOptions) (*EncoderOptions, error) {
+	if w == nil {
+		return nil, errors.New("nil writer")
+	}
+	if options == nil {
+		options = &QualityOptions{}
+	}
+	lo, hi := options.MinQuality, options.MaxQuality
+	if lo <= 0 {
+		lo = 1
+	}
+	if hi <= 0 || hi > 100 {
+		hi = 100
+	}
+	if lo > hi {
+		return nil, errors.New("invalid quality range")
+	}
+
+	e := new(Encoder)
+	defer e.Close()
+	d := new(Decoder)
+	defer d.Close()
+	// src is measured as the encoder sees it, composited onto the background.
+	bg := newBackground(options.Background)
+	var best, buf []byte
+	var bestOptions *EncoderOptions
+	for lo <= hi {
+		mode := options.EncoderOptions
+		mode.Quality = (lo + hi) / 2
+		var err error
+		buf, err = e.AppendEncode(buf[:0], src, &mode)
+		if err != nil {
+			return nil, err
+		}
+		img, err := d.Decode(newBytesReader(buf), nil)
+		if err != nil {
+			return nil, err
+		}
+		value, err := target.measure(src, img, bg)
+		if err != nil {
+			return nil, err
+		}
+		if value >= target.Value {
+			best, buf = buf, best
+			bestOptions = &mode
+			hi = mode.Quality - 1
+		} else {
+			lo = mode.Quality + 1
+		}
+	}
+	if bestOptions == nil {
+		return nil, ErrQualityNotReached
+	}
+	if _, err := w.Write(best); err != nil {
+		return nil, err
+	}
+	return bestOptions, nil
+}
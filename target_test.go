@@ -0,0 +1,134 @@
+package jpeg
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	"io/ioutil"
+	"testing"
+)
+
+func TestEncodeToSize(t *testing.T) {
+	data, err := ioutil.ReadFile("images/kinkaku.jpg")
+	if err != nil {
+		t.Fatalf("reading file: %v", err)
+	}
+	src, err := DecodeBytesIntoRGB(data, nil)
+	if err != nil {
+		t.Fatalf("DecodeIntoRGB returns error: %v", err)
+	}
+	ref, err := EncodeToBytes(src, &EncoderOptions{Quality: 50})
+	if err != nil {
+		t.Fatalf("EncodeToBytes returns error: %v", err)
+	}
+	maxBytes := len(ref)
+
+	var out bytes.Buffer
+	chosen, err := EncodeToSize(&out, src, maxBytes, nil)
+	if err != nil {
+		t.Fatalf("EncodeToSize returns error: %v", err)
+	}
+	if out.Len() > maxBytes || chosen.Quality < 50 {
+		t.Errorf("got %d bytes at quality %d, want at most %d at quality 50 or more", out.Len(), chosen.Quality, maxBytes)
+	}
+	if chosen.Quality < 100 {
+		next, err := EncodeToBytes(src, &EncoderOptions{Quality: chosen.Quality + 1})
+		if err != nil {
+			t.Fatalf("EncodeToBytes returns error: %v", err)
+		}
+		if len(next) <= maxBytes {
+			t.Errorf("quality %d also fits in %d bytes", chosen.Quality+1, maxBytes)
+		}
+	}
+	if _, err := Decode(&out, nil); err != nil {
+		t.Errorf("decoding output returns error: %v", err)
+	}
+
+	// Optimized coding saves bytes, which buys some quality.
+	out.Reset()
+	tried, err := EncodeToSize(&out, src, maxBytes, &SizeOptions{TryModes: true})
+	if err != nil {
+		t.Fatalf("EncodeToSize with TryModes returns error: %v", err)
+	}
+	if out.Len() > maxBytes || tried.Quality < chosen.Quality || !tried.OptimizeCoding {
+		t.Errorf("TryModes: got %d bytes with %+v", out.Len(), tried)
+	}
+
+	out.Reset()
+	if got, err := EncodeToSize(&out, src, 1<<30, &SizeOptions{MaxQuality: 90}); err != nil || got.Quality != 90 {
+		t.Errorf("with a large budget: got %+v, %v", got, err)
+	}
+
+	out.Reset()
+	if _, err := EncodeToSize(&out, src, 100, nil); !errors.Is(err, ErrSizeNotReached) || out.Len() != 0 {
+		t.Errorf("with a tiny budget: got %v and %d bytes", err, out.Len())
+	}
+}
+
+func TestEncodeToQuality(t *testing.T) {
+	data, err := ioutil.ReadFile("images/kinkaku.jpg")
+	if err != nil {
+		t.Fatalf("reading file: %v", err)
+	}
+	src, err := DecodeBytesIntoRGB(data, nil)
+	if err != nil {
+		t.Fatalf("DecodeIntoRGB returns error: %v", err)
+	}
+
+	for _, target := range []Metric{{MetricSSIM, 0.95}, {MetricPSNR, 38}} {
+		var out bytes.Buffer
+		chosen, err := EncodeToQuality(&out, src, target, nil)
+		if err != nil {
+			t.Fatalf("%+v: EncodeToQuality returns error: %v", target, err)
+		}
+		img, err := Decode(&out, nil)
+		if err != nil {
+			t.Fatalf("%+v: decoding output returns error: %v", target, err)
+		}
+		if v, _ := target.measure(src, img, newBackground(nil)); v < target.Value {
+			t.Errorf("%+v: got %v at quality %d", target, v, chosen.Quality)
+		}
+		if chosen.Quality > 1 {
+			lower, err := EncodeToBytes(src, &EncoderOptions{Quality: chosen.Quality - 1})
+			if err != nil {
+				t.Fatalf("EncodeToBytes returns error: %v", err)
+			}
+			img, err := DecodeBytes(lower, nil)
+			if err != nil {
+				t.Fatalf("Decode returns error: %v", err)
+			}
+			if v, _ := target.measure(src, img, newBackground(nil)); v >= target.Value {
+				t.Errorf("%+v: quality %d also reaches %v", target, chosen.Quality-1, v)
+			}
+		}
+	}
+
+	// Transparent pixels are measured on the background they are encoded
+	// onto.
+	translucent := image.NewNRGBA(image.Rect(0, 0, 64, 64))
+	draw.Draw(translucent, image.Rect(32, 0, 64, 64), src, image.Pt(400, 300), draw.Src)
+	for _, bg := range []color.Color{nil, color.Black} {
+		for _, target := range []Metric{{MetricSSIM, 0.9}, {MetricPSNR, 30}} {
+			var out bytes.Buffer
+			options := &QualityOptions{EncoderOptions: EncoderOptions{Background: bg}}
+			chosen, err := EncodeToQuality(&out, translucent, target, options)
+			if err != nil {
+				t.Fatalf("%v, %+v: EncodeToQuality returns error: %v", bg, target, err)
+			}
+			img, err := Decode(&out, nil)
+			if err != nil {
+				t.Fatalf("%v, %+v: decoding output returns error: %v", bg, target, err)
+			}
+			if v, _ := target.measure(translucent, img, newBackground(bg)); v < target.Value {
+				t.Errorf("%v, %+v: got %v at quality %d", bg, target, v, chosen.Quality)
+			}
+		}
+	}
+
+	var out bytes.Buffer
+	if _, err := EncodeToQuality(&out, src, Metric{MetricPSNR, 1000}, nil); !errors.Is(err, ErrQualityNotReached) || out.Len() != 0 {
+		t.Errorf("with an unreachable target: got %v and %d bytes", err, out.Len())
+	}
+}
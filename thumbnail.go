@@ -0,0 +1,168 @@
+package jpeg
+
+import (
+	"context"
+	"errors"
+	"image"
+	"io"
+	"math"
+)
+
+// ThumbnailMode specifies how an image is fitted into the thumbnail size.
+type ThumbnailMode int
+
+const (
+	// ThumbnailFit keeps the aspect ratio and makes the whole image fit
+	// inside the thumbnail size, so one dimension may be smaller.
+	ThumbnailFit ThumbnailMode = iota
+	// ThumbnailFill stretches the whole image to exactly the thumbnail size.
+	ThumbnailFill
+	// ThumbnailCrop keeps the aspect ratio, covers the thumbnail size and
+	// crops the center of the image to exactly that size.
+	ThumbnailCrop
+)
+
+// ThumbnailOptions specifies thumbnail parameters.
+type ThumbnailOptions struct {
+	Mode   ThumbnailMode // Mode is how the image is fitted into the thumbnail size.
+	Filter Filter        // Filter is the resampling filter.
+
+	// DecoderOptions is used to decode the image. Its scale is chosen by
+	// Thumbnail.
+	DecoderOptions
+}
+
+// thumbnailGeometry returns the size of the thumbnail of an image of width x
+// height and the area of the image it shows.
+func thumbnailGeometry(width, height, tw, th int, mode ThumbnailMode) (dw, dh int, area rect) {
+	area = rect{0, 0, float64(width), float64(height)}
+	switch mode {
+	case ThumbnailFill:
+		return tw, th, area
+	case ThumbnailCrop:
+		r := math.Max(float64(tw)/float64(width), float64(th)/float64(height))
+		area.w, area.h = float64(tw)/r, float64(th)/r
+		area.x, area.y = (float64(width)-area.w)/2, (float64(height)-area.h)/2
+		return tw, th, area
+	default:
+		r := math.Min(float64(tw)/float64(width), float64(th)/float64(height))
+		dw = int(math.Max(1, math.Round(float64(width)*r)))
+		dh = int(math.Max(1, math.Round(float64(height)*r)))
+		return dw, dh, area
+	}
+}
+
+// rect is an area of an image in fractional pixels.
+type rect struct {
+	x, y, w, h float64
+}
+
+// Thumbnail reads a JPEG data stream from r and returns it resized to width
+// x height according to options.
+//
+// The image is decoded at the smallest DCT scale that is still at least as
+// large as the thumbnail, which saves most of the decoding work, and then
+// resampled on its YCbCr planes to the exact size. The result can be given to
+// Encode as is.
+func Thumbnail(r io.Reader, width, height int, options *ThumbnailOptions) (dest image.Image, err error) {
+	d := new(Decoder)
+	defer d.Close()
+	return d.Thumbnail(r, width, height, options)
+}
+
+// Thumbnail reads a JPEG data stream from r and returns it resized to width
+// x height according to options.
+func (d *Decoder) Thumbnail(r io.Reader, width, height int, options *ThumbnailOptions) (dest image.Image, err error) {
+	if width <= 0 || height <= 0 {
+		return nil, errors.New("invalid thumbnail size")
+	}
+	if options == nil {
+		options = &ThumbnailOptions{}
+	}
+
+	var dw, dh, imageWidth, imageHeight int
+	var area rect
+	chooseScale := func(w, h int) Scale {
+		imageWidth, imageHeight = w, h
+		dw, dh, area = thumbnailGeometry(w, h, width, height, options.Mode)
+		n := 1
+		for ; n < 16; n++ {
+			if area.w*float64(n)/8 >= float64(dw) && area.h*float64(n)/8 >= float64(dh) {
+				break
+			}
+		}
+		return Scale{n, 8}
+	}
+	img, err := d.decode(context.Background(), r, &options.DecoderOptions, chooseScale)
+	if err != nil {
+		return nil, err
+	}
+
+	// Map the area to the decoded image, whose size is rounded up from the
+	// scaled size.
+	bounds := img.Bounds()
+	sx := float64(bounds.Dx()) / float64(imageWidth)
+	sy := float64(bounds.Dy()) / float64(imageHeight)
+	area = rect{area.x * sx, area.y * sy, area.w * sx, area.h * sy}
+	return resizeImage(img, dw, dh, area, options.Filter), nil
+}
+
+// resizeImage resamples area of a decoded image into a new image of the same
+// type with size w x h.
+func resizeImage(img image.Image, w, h int, area rect, f Filter) image.Image {
+	switch src := img.(type) {
+	case *image.YCbCr:
+		dst := image.NewYCbCr(image.Rect(0, 0, w, h), src.SubsampleRatio)
+		b := src.Rect
+		resample(
+			plane{dst.Y, dst.YStride, w, h, 1},
+			plane{src.Y, src.YStride, b.Dx(), b.Dy(), 1},
+			area.x, area.y, area.w, area.h, f)
+
+		// The chroma planes cover the same area at a lower resolution.
+		hdiv, vdiv := subsampleDivisors(src.SubsampleRatio)
+		cx, cy := float64(hdiv), float64(vdiv)
+		for _, p := range [][2][]uint8{{dst.Cb, src.Cb}, {dst.Cr, src.Cr}} {
+			resample(
+				plane{p[0], dst.CStride, (w + hdiv - 1) / hdiv, (h + vdiv - 1) / vdiv, 1},
+				plane{p[1], src.CStride, (b.Dx() + hdiv - 1) / hdiv, (b.Dy() + vdiv - 1) / vdiv, 1},
+				area.x/cx, area.y/cy, area.w/cx, area.h/cy, f)
+		}
+		return dst
+	case *image.Gray:
+		dst := image.NewGray(image.Rect(0, 0, w, h))
+		b := src.Rect
+		resample(
+			plane{dst.Pix, dst.Stride, w, h, 1},
+			plane{src.Pix, src.Stride, b.Dx(), b.Dy(), 1},
+			area.x, area.y, area.w, area.h, f)
+		return dst
+	case *RGB:
+		dst := NewRGB(image.Rect(0, 0, w, h))
+		b := src.Rect
+		resample(
+			plane{dst.Pix, dst.Stride, w, h, 3},
+			plane{src.Pix, src.Stride, b.Dx(), b.Dy(), 3},
+			area.x, area.y, area.w, area.h, f)
+		return dst
+	}
+	panic("unexpected image type")
+}
+
+// subsampleDivisors returns the horizontal and vertical subsampling factors
+// of the chroma planes.
+func subsampleDivisors(ratio image.YCbCrSubsampleRatio) (h, v int) {
+	switch ratio {
+	case image.YCbCrSubsampleRatio422:
+		return 2, 1
+	case image.YCbCrSubsampleRatio420:
+		return 2, 2
+	case image.YCbCrSubsampleRatio440:
+		return 1, 2
+	case image.YCbCrSubsampleRatio411:
+		return 4, 1
+	case image.YCbCrSubsampleRatio410:
+		return 4, 2
+	}
+	return 1, 1
+}
@@ -0,0 +1,54 @@
+package jpeg
+
+import (
+	"io"
+)
+
+// TranscodeOptions specifies how a JPEG image is rewritten by Transcode.
+type TranscodeOptions struct {
+	Progressive    bool  // If true, write a progressive image.
+	OptimizeCoding bool  // If true, compute optimal Huffman tables.
+	Arithmetic     bool  // If true, use arithmetic coding instead of Huffman coding.
+	StripMarkers   bool  // If true, drop the APPn and COM markers except those in KeepMarkers.
+	KeepMarkers    []int // KeepMarkers are the marker codes kept by StripMarkers, such as MarkerAPP0+2 for ICC profiles.
+}
+
+// Transcode reads a JPEG image from r and rewrites its entropy coding into w
+// according to options. The DCT coefficients are copied as they are, so the
+// pixels do not change at all; only the file size does.
+func Transcode(r io.Reader, w io.Writer, options TranscodeOptions) error {
+	markers := CopyAll
+	if options.StripMarkers && len(options.KeepMarkers) == 0 {
+		markers = CopyNone
+	}
+	d := new(Decoder)
+	defer d.Close()
+	c, err := d.readCoefficients(r, nil, markers)
+	if err != nil {
+		return err
+	}
+	if options.StripMarkers {
+		c.Markers = keepMarkers(c.Markers, options.KeepMarkers)
+	}
+	e := new(Encoder)
+	defer e.Close()
+	return e.writeCoefficients(w, c, &CoefficientOptions{
+		ProgressiveMode: options.Progressive,
+		OptimizeCoding:  options.OptimizeCoding,
+		Arithmetic:      options.Arithmetic,
+	})
+}
+
+// keepMarkers returns the markers whose code is in codes.
+func keepMarkers(markers []Marker, codes []int) []Marker {
+	var kept []Marker
+	for _, m := range markers {
+		for _, code := range codes {
+			if m.Code == code {
+				kept = append(kept, m)
+				break
+			}
+		}
+	}
+	return kept
+}
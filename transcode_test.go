@@ -0,0 +1,86 @@
+package jpeg
+
+import (
+	"bytes"
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+func TestTranscode(t *testing.T) {
+	data, err := ioutil.ReadFile("images/kinkaku.jpg")
+	if err != nil {
+		t.Fatalf("reading file: %v", err)
+	}
+	src, err := ReadCoefficients(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("ReadCoefficients returns error: %v", err)
+	}
+
+	tests := []struct {
+		options TranscodeOptions
+		sof     byte
+	}{
+		{TranscodeOptions{}, 0xc0},
+		{TranscodeOptions{OptimizeCoding: true}, 0xc0},
+		{TranscodeOptions{Progressive: true}, 0xc2},
+		{TranscodeOptions{Arithmetic: true}, 0xc9},
+		{TranscodeOptions{Progressive: true, Arithmetic: true}, 0xca},
+	}
+	var sizes []int
+	for _, test := range tests {
+		var out bytes.Buffer
+		if err := Transcode(bytes.NewReader(data), &out, test.options); err != nil {
+			t.Fatalf("%+v: Transcode returns error: %v", test.options, err)
+		}
+		sizes = append(sizes, out.Len())
+		if !bytes.Contains(out.Bytes(), []byte{0xff, test.sof}) {
+			t.Errorf("%+v: no SOF marker %#x", test.options, test.sof)
+		}
+		c, err := ReadCoefficients(&out)
+		if err != nil {
+			t.Fatalf("%+v: reading transcoded image returns error: %v", test.options, err)
+		}
+		if !reflect.DeepEqual(c.Components, src.Components) || !reflect.DeepEqual(c.QuantTables, src.QuantTables) {
+			t.Errorf("%+v: coefficients changed", test.options)
+		}
+	}
+	if sizes[1] > sizes[0] {
+		t.Errorf("optimized output is %d bytes, larger than %d", sizes[1], sizes[0])
+	}
+}
+
+func TestTranscodeMarkers(t *testing.T) {
+	data, err := ioutil.ReadFile("images/testdata/video-001.jpeg")
+	if err != nil {
+		t.Fatalf("reading file: %v", err)
+	}
+	comment := []byte("go-libjpeg test comment")
+	app2 := []byte("ICC_PROFILE\x00test")
+	withMarkers := []byte{0xff, 0xd8, 0xff, 0xfe, 0, byte(len(comment) + 2)}
+	withMarkers = append(withMarkers, comment...)
+	withMarkers = append(withMarkers, 0xff, 0xe2, 0, byte(len(app2)+2))
+	withMarkers = append(withMarkers, app2...)
+	withMarkers = append(withMarkers, data[2:]...)
+
+	tests := []struct {
+		options       TranscodeOptions
+		comment, app2 bool
+	}{
+		{TranscodeOptions{}, true, true},
+		{TranscodeOptions{StripMarkers: true}, false, false},
+		{TranscodeOptions{StripMarkers: true, KeepMarkers: []int{MarkerAPP0 + 2}}, false, true},
+	}
+	for _, test := range tests {
+		var out bytes.Buffer
+		if err := Transcode(bytes.NewReader(withMarkers), &out, test.options); err != nil {
+			t.Fatalf("%+v: Transcode returns error: %v", test.options, err)
+		}
+		if got := bytes.Contains(out.Bytes(), comment); got != test.comment {
+			t.Errorf("%+v: comment kept: %v, want %v", test.options, got, test.comment)
+		}
+		if got := bytes.Contains(out.Bytes(), app2); got != test.app2 {
+			t.Errorf("%+v: APP2 kept: %v, want %v", test.options, got, test.app2)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package jpeg
+
+import (
+	"errors"
+	"io"
+)
+
+// TransformOp is a lossless transformation of a JPEG image.
+type TransformOp int
+
+const (
+	// TransformNone leaves the image as is.
+	TransformNone TransformOp = iota
+	// Rotate90 rotates the image 90 degrees clockwise.
+	Rotate90
+	// Rotate180 rotates the image 180 degrees.
+	Rotate180
+	// Rotate270 rotates the image 270 degrees clockwise.
+	Rotate270
+	// FlipH mirrors the image horizontally.
+	FlipH
+	// FlipV mirrors the image vertically.
+	FlipV
+	// Transpose mirrors the image across its upper-left to lower-right axis.
+	Transpose
+	// Transverse mirrors the image across its upper-right to lower-left axis.
+	Transverse
+)
+
+// TransformOptions specifies a lossless transformation.
+//
+// The DCT blocks of an image can only be moved as whole iMCUs, so a partial
+// iMCU at an edge which the transformation moves to the opposite side cannot
+// be transformed. By default such edge blocks are left in place untransformed
+// like jpegtran does. Trim drops them instead, and Perfect makes the
+// transformation fail.
+//
+// Grayscale keeps only the luma blocks of a YCbCr image, like jpegtran
+// -grayscale, before the image is transformed.
+type TransformOptions struct {
+	Op          TransformOp
+	Grayscale   bool       // If true, drop the chroma components.
+	Trim        bool       // If true, drop partial iMCUs which cannot be transformed.
+	Perfect     bool       // If true, fail if there are partial iMCUs which cannot be transformed.
+	CopyMarkers MarkerCopy // CopyMarkers specifies which extra markers are kept (CopyComments by default).
+}
+
+// Transform reads a JPEG image from r, transforms it without decoding its
+// pixels and writes the result into w, so that no quality is lost.
+//
+// The output keeps the quantization tables of the input and is progressive if
+// the input is.
+func Transform(r io.Reader, w io.Writer, options TransformOptions) error {
+	d := new(Decoder)
+	defer d.Close()
+	c, err := d.readCoefficients(r, nil, options.CopyMarkers)
+	if err != nil {
+		return err
+	}
+	if options.Grayscale {
+		c, err = grayCoefficients(c)
+		if err != nil {
+			return err
+		}
+	}
+	c, err = transformCoefficients(c, &options)
+	if err != nil {
+		return err
+	}
+	e := new(Encoder)
+	defer e.Close()
+	return e.writeCoefficients(w, c, &CoefficientOptions{ProgressiveMode: c.Progressive, OptimizeCoding: true})
+}
+
+// transformCoefficients returns a copy of src transformed by options, using
+// the same block rearrangement as libjpeg's transupp.
+func transformCoefficients(src *Coefficients, options *TransformOptions) (*Coefficients, error) {
+	var transpose, flipH, flipV bool
+	switch options.Op {
+	case TransformNone:
+	case Rotate90:
+		transpose, flipH = true, true
+	case Rotate180:
+		flipH, flipV = true, true
+	case Rotate270:
+		transpose, flipV = true, true
+	case FlipH:
+		flipH = true
+	case FlipV:
+		flipV = true
+	case Transpose:
+		transpose = true
+	case Transverse:
+		transpose, flipH, flipV = true, true, true
+	default:
+		return nil, errors.New("unknown transform")
+	}
+
+	dst := *src
+	dst.Components = make([]Component, len(src.Components))
+	copy(dst.Components, src.Components)
+	if transpose {
+		dst.Width, dst.Height = src.Height, src.Width
+		for i := range dst.Components {
+			comp := &dst.Components[i]
+			comp.HSampFactor, comp.VSampFactor = comp.VSampFactor, comp.HSampFactor
+		}
+		// The quantization tables follow the transposed coefficients.
+		for i, table := range src.QuantTables {
+			if table == nil {
+				continue
+			}
+			dst.QuantTables[i] = make([]uint16, len(table))
+			for row := 0; row < 8; row++ {
+				for col := 0; col < 8; col++ {
+					dst.QuantTables[i][row*8+col] = table[col*8+row]
+				}
+			}
+		}
+	}
+
+	// The flips are done in the destination coordinates, after the
+	// transposition.
+	iMCUWidth, iMCUHeight := dst.iMCUSize()
+	if flipH && dst.Width%iMCUWidth != 0 {
+		if options.Perfect {
+			return nil, errors.New("transform is not perfect")
+		}
+		if options.Trim && dst.Width >= iMCUWidth {
+			dst.Width -= dst.Width % iMCUWidth
+		}
+	}
+	if flipV && dst.Height%iMCUHeight != 0 {
+		if options.Perfect {
+			return nil, errors.New("transform is not perfect")
+		}
+		if options.Trim && dst.Height >= iMCUHeight {
+			dst.Height -= dst.Height % iMCUHeight
+		}
+	}
+	mcuCols, mcuRows := dst.Width/iMCUWidth, dst.Height/iMCUHeight
+
+	dst.Allocate()
+	for i := range dst.Components {
+		d, s := &dst.Components[i], &src.Components[i]
+		// Only the blocks of whole iMCUs can be mirrored.
+		mirrorWidth, mirrorHeight := mcuCols*d.HSampFactor, mcuRows*d.VSampFactor
+		for y := 0; y < d.HeightInBlocks; y++ {
+			for x := 0; x < d.WidthInBlocks; x++ {
+				sx, sy := x, y
+				fh, fv := flipH && x < mirrorWidth, flipV && y < mirrorHeight
+				if fh {
+					sx = mirrorWidth - 1 - x
+				}
+				if fv {
+					sy = mirrorHeight - 1 - y
+				}
+				if transpose {
+					sx, sy = sy, sx
+				}
+				if sx >= s.WidthInBlocks || sy >= s.HeightInBlocks {
+					continue
+				}
+				transformBlock(d.Block(x, y), s.Block(sx, sy), transpose, fh, fv)
+			}
+		}
+	}
+	return &dst, nil
+}
+
+// grayCoefficients returns the luma component of src as a grayscale image.
+func grayCoefficients(src *Coefficients) (*Coefficients, error) {
+	switch src.ColorSpace {
+	case ColorSpaceGrayscale:
+		return src, nil
+	case ColorSpaceYCbCr:
+	default:
+		return nil, errors.New("grayscale conversion requires a YCbCr image")
+	}
+	dst := *src
+	dst.ColorSpace = ColorSpaceGrayscale
+	luma := src.Components[0]
+	// A single component is not interleaved, so its iMCU is one block.
+	dst.Components = []Component{{ID: luma.ID, HSampFactor: 1, VSampFactor: 1, QuantTable: luma.QuantTable}}
+	dst.QuantTables = [4][]uint16{}
+	dst.QuantTables[luma.QuantTable] = src.QuantTables[luma.QuantTable]
+	dst.Allocate()
+	d := &dst.Components[0]
+	for y := 0; y < d.HeightInBlocks; y++ {
+		copy(d.Blocks[y*d.WidthInBlocks:(y+1)*d.WidthInBlocks], luma.Blocks[y*luma.WidthInBlocks:])
+	}
+	return &dst, nil
+}
+
+// transformBlock transposes the DCT block src into dst if transpose is set,
+// and then mirrors it. Mirroring a block negates its odd frequencies along
+// the mirrored axis.
+func transformBlock(dst, src *Block, transpose, flipH, flipV bool) {
+	for row := 0; row < 8; row++ {
+		for col := 0; col < 8; col++ {
+			v := src[row*8+col]
+			if transpose {
+				v = src[col*8+row]
+			}
+			if (flipH && col%2 == 1) != (flipV && row%2 == 1) {
+				v = -v
+			}
+			dst[row*8+col] = v
+		}
+	}
+}
@@ -0,0 +1,246 @@
+package jpeg
+
+import (
+	"bytes"
+	"image"
+	"io/ioutil"
+	"testing"
+)
+
+var transformOps = []struct {
+	op   TransformOp
+	name string
+	// at returns the source pixel of the pixel (x, y) of a transformed image
+	// of w x h.
+	at func(x, y, w, h int) (int, int)
+}{
+	{TransformNone, "none", func(x, y, w, h int) (int, int) { return x, y }},
+	{Rotate90, "rot90", func(x, y, w, h int) (int, int) { return y, w - 1 - x }},
+	{Rotate180, "rot180", func(x, y, w, h int) (int, int) { return w - 1 - x, h - 1 - y }},
+	{Rotate270, "rot270", func(x, y, w, h int) (int, int) { return h - 1 - y, x }},
+	{FlipH, "fliph", func(x, y, w, h int) (int, int) { return w - 1 - x, y }},
+	{FlipV, "flipv", func(x, y, w, h int) (int, int) { return x, h - 1 - y }},
+	{Transpose, "transpose", func(x, y, w, h int) (int, int) { return y, x }},
+	{Transverse, "transverse", func(x, y, w, h int) (int, int) { return h - 1 - y, w - 1 - x }},
+}
+
+// transformDiff returns the mean difference between the area b of img and
+// src transformed with at.
+func transformDiff(img image.Image, b image.Rectangle, src image.Image, at func(x, y, w, h int) (int, int)) float64 {
+	sb := src.Bounds()
+	var sum, n float64
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			sx, sy := at(x, y, b.Dx(), b.Dy())
+			r0, g0, b0, _ := img.At(b.Min.X+x, b.Min.Y+y).RGBA()
+			r1, g1, b1, _ := src.At(sb.Min.X+sx, sb.Min.Y+sy).RGBA()
+			sum += float64(delta2(r0, r1)+delta2(g0, g1)+delta2(b0, b1)) / 3
+			n++
+		}
+	}
+	return sum / n
+}
+
+func TestTransform(t *testing.T) {
+	files := []string{
+		"images/kinkaku.jpg",
+		"images/testdata/video-001.q50.420.jpeg",
+		"images/testdata/video-001.q50.422.progressive.jpeg",
+		"images/testdata/video-001.q50.440.jpeg",
+		"images/testdata/video-001.q50.444.jpeg",
+		"images/testdata/video-001.q50.411.jpeg",
+		"images/testdata/video-001.q50.410.progressive.jpeg",
+		"images/testdata/video-001.rgb.jpeg",
+		"images/testdata/video-005.gray.q50.jpeg",
+		"images/testdata/video-005.gray.q50.2x2.jpeg",
+	}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatalf("reading file: %v", err)
+		}
+		src, err := DecodeBytesIntoRGB(data, nil)
+		if err != nil {
+			t.Fatalf("%s: DecodeIntoRGB returns error: %v", file, err)
+		}
+		sw, sh := src.Bounds().Dx(), src.Bounds().Dy()
+
+		for _, test := range transformOps {
+			var out bytes.Buffer
+			err := Transform(bytes.NewReader(data), &out, TransformOptions{Op: test.op, Trim: true})
+			if err != nil {
+				t.Fatalf("%s: %s returns error: %v", file, test.name, err)
+			}
+			img, err := DecodeBytesIntoRGB(out.Bytes(), nil)
+			if err != nil {
+				t.Fatalf("%s: decoding %s returns error: %v", file, test.name, err)
+			}
+			w, h := img.Bounds().Dx(), img.Bounds().Dy()
+			switch test.op {
+			case Rotate90, Rotate270, Transpose, Transverse:
+				w, h = h, w
+			}
+			if w > sw || h > sh || sw-w >= 32 || sh-h >= 32 {
+				t.Errorf("%s: %s: got %v from %dx%d", file, test.name, img.Bounds(), sw, sh)
+			}
+			if d := transformDiff(img, img.Bounds(), src, test.at); d > 2*0x101 {
+				t.Errorf("%s: %s differs by %v", file, test.name, d)
+			}
+		}
+	}
+}
+
+func TestTransformEdges(t *testing.T) {
+	// video-001 is 150x103, which leaves partial iMCUs on the right and
+	// bottom edges.
+	data, err := ioutil.ReadFile("images/testdata/video-001.q50.420.jpeg")
+	if err != nil {
+		t.Fatalf("reading file: %v", err)
+	}
+	src, err := DecodeBytesIntoRGB(data, nil)
+	if err != nil {
+		t.Fatalf("DecodeIntoRGB returns error: %v", err)
+	}
+
+	for _, test := range transformOps {
+		perfect := test.op == TransformNone || test.op == Transpose
+		err := Transform(bytes.NewReader(data), ioutil.Discard, TransformOptions{Op: test.op, Perfect: true})
+		if perfect && err != nil {
+			t.Errorf("%s: Perfect returns error: %v", test.name, err)
+		} else if !perfect && err == nil {
+			t.Errorf("%s: Perfect returns no error", test.name)
+		}
+
+		// Without Trim the size is kept and the whole iMCUs are transformed.
+		var out bytes.Buffer
+		if err := Transform(bytes.NewReader(data), &out, TransformOptions{Op: test.op}); err != nil {
+			t.Fatalf("%s returns error: %v", test.name, err)
+		}
+		img, err := DecodeBytesIntoRGB(out.Bytes(), nil)
+		if err != nil {
+			t.Fatalf("decoding %s returns error: %v", test.name, err)
+		}
+		w, h := 150, 103
+		switch test.op {
+		case Rotate90, Rotate270, Transpose, Transverse:
+			w, h = h, w
+		}
+		if got := img.Bounds(); got.Dx() != w || got.Dy() != h {
+			t.Errorf("%s: got %v, want %dx%d", test.name, got, w, h)
+		}
+		if test.op == FlipV {
+			// The rows of whole iMCUs are mirrored within the first 96 rows.
+			if d := transformDiff(img, image.Rect(0, 0, 150, 96), src, func(x, y, w, h int) (int, int) { return x, 95 - y }); d > 2*0x101 {
+				t.Errorf("%s differs by %v", test.name, d)
+			}
+		}
+	}
+}
+
+func TestTransformMarkers(t *testing.T) {
+	data, err := ioutil.ReadFile("images/testdata/video-001.progressive.jpeg")
+	if err != nil {
+		t.Fatalf("reading file: %v", err)
+	}
+	comment := []byte("go-libjpeg test comment")
+	withComment := append([]byte{0xff, 0xd8, 0xff, 0xfe, 0, byte(len(comment) + 2)}, comment...)
+	withComment = append(withComment, data[2:]...)
+
+	for _, copyMarkers := range []MarkerCopy{CopyNone, CopyComments, CopyAll} {
+		var out bytes.Buffer
+		err := Transform(bytes.NewReader(withComment), &out, TransformOptions{Op: Rotate180, CopyMarkers: copyMarkers})
+		if err != nil {
+			t.Fatalf("Transform returns error: %v", err)
+		}
+		if got, want := bytes.Contains(out.Bytes(), comment), copyMarkers != CopyNone; got != want {
+			t.Errorf("CopyMarkers %d: comment kept: %v, want %v", copyMarkers, got, want)
+		}
+		if got := bytes.Count(out.Bytes(), []byte("JFIF\x00")); got != 1 {
+			t.Errorf("CopyMarkers %d: got %d JFIF markers", copyMarkers, got)
+		}
+		if !bytes.Contains(out.Bytes(), []byte{0xff, 0xc2}) {
+			t.Errorf("CopyMarkers %d: output is not progressive", copyMarkers)
+		}
+	}
+
+	// Like jpegtran, comments are kept by default.
+	var out bytes.Buffer
+	if err := Transform(bytes.NewReader(withComment), &out, TransformOptions{Op: Rotate180}); err != nil {
+		t.Fatalf("Transform returns error: %v", err)
+	}
+	if !bytes.Contains(out.Bytes(), comment) {
+		t.Errorf("comment dropped with the default options")
+	}
+}
+
+func TestTransformGrayscale(t *testing.T) {
+	files := []string{
+		"images/kinkaku.jpg",
+		"images/testdata/video-001.q50.420.progressive.jpeg",
+		"images/testdata/video-001.q50.422.jpeg",
+		"images/testdata/video-005.gray.q50.jpeg",
+	}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatalf("reading file: %v", err)
+		}
+		src, err := Decode(bytes.NewReader(data), nil)
+		if err != nil {
+			t.Fatalf("%s: Decode returns error: %v", file, err)
+		}
+
+		var out bytes.Buffer
+		if err := Transform(bytes.NewReader(data), &out, TransformOptions{Grayscale: true}); err != nil {
+			t.Fatalf("%s: Transform returns error: %v", file, err)
+		}
+		img, err := Decode(&out, nil)
+		if err != nil {
+			t.Fatalf("%s: decoding grayscale image returns error: %v", file, err)
+		}
+		gray, ok := img.(*image.Gray)
+		if !ok {
+			t.Fatalf("%s: got %T, want *image.Gray", file, img)
+		}
+		if gray.Bounds() != src.Bounds() {
+			t.Fatalf("%s: got %v, want %v", file, gray.Bounds(), src.Bounds())
+		}
+		// The luma blocks are kept as they are, so the pixels are the same
+		// as the luma of the original.
+		b := gray.Bounds()
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				var want uint8
+				switch src := src.(type) {
+				case *image.YCbCr:
+					want = src.Y[src.YOffset(x, y)]
+				case *image.Gray:
+					want = src.GrayAt(x, y).Y
+				}
+				if got := gray.GrayAt(x, y).Y; got != want {
+					t.Fatalf("%s: pixel (%d, %d) is %d, want %d", file, x, y, got, want)
+				}
+			}
+		}
+
+		out.Reset()
+		if err := Transform(bytes.NewReader(data), &out, TransformOptions{Op: Rotate90, Grayscale: true}); err != nil {
+			t.Fatalf("%s: Transform returns error: %v", file, err)
+		}
+		img, err = Decode(&out, nil)
+		if err != nil {
+			t.Fatalf("%s: decoding rotated grayscale image returns error: %v", file, err)
+		}
+		if _, ok := img.(*image.Gray); !ok || img.Bounds().Dx() != b.Dy() || img.Bounds().Dy() != b.Dx() {
+			t.Errorf("%s: rotated grayscale image is %T %v", file, img, img.Bounds())
+		}
+	}
+
+	data, err := ioutil.ReadFile("images/testdata/video-001.cmyk.jpeg")
+	if err != nil {
+		t.Fatalf("reading file: %v", err)
+	}
+	if err := Transform(bytes.NewReader(data), ioutil.Discard, TransformOptions{Grayscale: true}); err == nil {
+		t.Errorf("Grayscale on a CMYK image returns no error")
+	}
+}